@@ -0,0 +1,113 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+)
+
+// isAdBlockHeader reports whether the line is the header of the AdBlock Plus or AutoProxy (gfwlist) rule list,
+// such as '[Adblock Plus 2.0]' or '[AutoProxy 0.2.9]'.
+func isAdBlockHeader(line string) bool {
+	line = strings.ToLower(strings.TrimSpace(line))
+	return strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") &&
+		(strings.Contains(line, "adblock") || strings.Contains(line, "autoproxy"))
+}
+
+// decodeAdBlockList decodes the base64 wrapped rule list, such as the gfwlist.
+func decodeAdBlockList(data []byte) ([]byte, bool) {
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, string(data))
+	if s == "" {
+		return nil, false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	line := b
+	if n := bytes.IndexByte(b, '\n'); n >= 0 {
+		line = b[:n]
+	}
+	if !isAdBlockHeader(string(line)) {
+		return nil, false
+	}
+	return b, true
+}
+
+// parseAdBlockRule converts the rule in the AdBlock Plus syntax to a Matcher.
+// The exception is true for the exception rule ('@@' prefix).
+// Only the host part of the rule is used, the rules which can not be applied to the host,
+// such as comments, regular expressions, keywords and element hiding rules, are ignored and the Matcher is nil.
+func parseAdBlockRule(rule string) (m Matcher, exception bool) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || rule[0] == '!' || rule[0] == '[' {
+		return
+	}
+	if strings.Contains(rule, "##") || strings.Contains(rule, "#@#") {
+		return // element hiding
+	}
+	if strings.HasPrefix(rule, "@@") {
+		exception = true
+		rule = rule[2:]
+	}
+	if n := strings.IndexByte(rule, '$'); n >= 0 {
+		rule = rule[:n] // filter options
+	}
+	if len(rule) > 1 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+		return nil, false // regular expression
+	}
+
+	var pattern string
+	switch {
+	case strings.HasPrefix(rule, "||"): // the domain and its subdomains
+		host := adBlockHost(rule[2:])
+		if net.ParseIP(host) != nil {
+			pattern = host
+		} else if host != "" {
+			pattern = "." + host
+		}
+	case strings.HasPrefix(rule, "|"): // the address start
+		rule = rule[1:]
+		if n := strings.Index(rule, "://"); n >= 0 {
+			rule = rule[n+3:]
+		}
+		pattern = adBlockHost(rule)
+	case strings.HasPrefix(rule, "."):
+		if host := adBlockHost(rule[1:]); host != "" {
+			pattern = "." + host
+		}
+	default:
+		host := adBlockHost(rule)
+		if !strings.Contains(host, ".") {
+			return nil, false // keyword
+		}
+		if net.ParseIP(host) != nil || strings.HasPrefix(host, "*") {
+			pattern = host
+		} else {
+			pattern = "." + host
+		}
+	}
+	if pattern == "" || pattern == "." {
+		return nil, false
+	}
+	return NewMatcher(pattern), exception
+}
+
+// adBlockHost extracts the host part from the rule.
+func adBlockHost(s string) string {
+	if n := strings.IndexAny(s, "/^|?"); n >= 0 {
+		s = s[:n]
+	}
+	if n := strings.LastIndexByte(s, ':'); n >= 0 && strings.Count(s, ":") == 1 {
+		s = s[:n] // port
+	}
+	return strings.ToLower(strings.Trim(s, "."))
+}
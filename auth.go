@@ -0,0 +1,398 @@
+package gost
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator is an interface for user authentication.
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// UserPermissions is an optional interface implemented by the Authenticator,
+// it returns the permissions attached to the user.
+// The ok is false if there are no permissions for the user.
+type UserPermissions interface {
+	UserPermissions(user string) (whitelist, blacklist *Permissions, ok bool)
+}
+
+// IdentityAuthenticator is an optional interface implemented by the Authenticator,
+// it returns the identity of the entry matched by the user-password pair.
+// The identity is used to look up the permissions of the user, instead of the user name sent by the client.
+type IdentityAuthenticator interface {
+	Identify(user, password string) (identity string, ok bool)
+}
+
+// authenticate checks the user-password pair by the Authenticator, and returns the identity of the client.
+// The identity is the user name if the Authenticator does not implement IdentityAuthenticator.
+func authenticate(au Authenticator, user, password string) (string, bool) {
+	if au == nil {
+		return user, true
+	}
+	if ia, ok := au.(IdentityAuthenticator); ok {
+		return ia.Identify(user, password)
+	}
+	return user, au.Authenticate(user, password)
+}
+
+// UserLister is an optional interface implemented by the Authenticator,
+// it returns the users with the plaintext passwords, such as the users sharing the secrets file
+// with the ciphers keyed by the passwords. The users of the hashed passwords are omitted.
+type UserLister interface {
+	Users() []*url.Userinfo
+}
+
+// LocalAuthenticator is an Authenticator that authenticates client by local key-value pairs.
+// A user with an empty password is authenticated by the user name only,
+// a user with an empty name is authenticated by the password only.
+// The password can be plaintext or one of the hash formats supported by htpasswd:
+// bcrypt ($2a$, $2b$, $2y$), SHA1 ({SHA}) and Apache MD5 ($apr1$).
+// An Authenticator without any pairs authenticates all the clients,
+// unless it has been reloaded from a config, then it fails closed.
+type LocalAuthenticator struct {
+	base   map[string]string // the pairs added by NewLocalAuthenticator and Add, they survive the reloading.
+	kvs    map[string]string
+	perms  map[string]*userPermissions
+	loaded bool // the pairs have been reloaded from a config
+	period time.Duration
+	mux    sync.RWMutex
+}
+
+type userPermissions struct {
+	whitelist *Permissions
+	blacklist *Permissions
+}
+
+// NewLocalAuthenticator creates an Authenticator that authenticates client by local infos.
+func NewLocalAuthenticator(kvs map[string]string) *LocalAuthenticator {
+	au := &LocalAuthenticator{
+		base: make(map[string]string),
+		kvs:  make(map[string]string),
+	}
+	for k, v := range kvs {
+		au.base[k] = v
+		au.kvs[k] = v
+	}
+	return au
+}
+
+// UsersAuthenticator creates a LocalAuthenticator from the user list,
+// it returns nil if the list is empty.
+func UsersAuthenticator(users ...*url.Userinfo) Authenticator {
+	if len(users) == 0 {
+		return nil
+	}
+	au := NewLocalAuthenticator(nil)
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		password, _ := user.Password()
+		au.Add(user.Username(), password)
+	}
+	return au
+}
+
+// Authenticate checks the validity of the provided user-password pair.
+func (au *LocalAuthenticator) Authenticate(user, password string) bool {
+	_, ok := au.Identify(user, password)
+	return ok
+}
+
+// Identify checks the validity of the provided user-password pair, and returns the name of the matched entry,
+// it is empty if the client is authenticated by the password only.
+func (au *LocalAuthenticator) Identify(user, password string) (identity string, ok bool) {
+	if au == nil {
+		return "", true
+	}
+
+	au.mux.RLock()
+	defer au.mux.RUnlock()
+
+	if len(au.kvs) == 0 {
+		return "", !au.loaded
+	}
+
+	if v, ok := au.kvs[user]; ok && (v == "" || comparePassword(v, password)) {
+		return user, true
+	}
+	if v, ok := au.kvs[""]; ok && comparePassword(v, password) {
+		return "", true
+	}
+	return "", false
+}
+
+// UserPermissions returns the permissions of the user loaded from the config.
+func (au *LocalAuthenticator) UserPermissions(user string) (whitelist, blacklist *Permissions, ok bool) {
+	if au == nil {
+		return
+	}
+
+	au.mux.RLock()
+	defer au.mux.RUnlock()
+
+	perms := au.perms[user]
+	if perms == nil {
+		return
+	}
+	return perms.whitelist, perms.blacklist, true
+}
+
+// Users returns the users with the plaintext passwords, sorted by the user name.
+func (au *LocalAuthenticator) Users() []*url.Userinfo {
+	if au == nil {
+		return nil
+	}
+
+	au.mux.RLock()
+	defer au.mux.RUnlock()
+
+	var users []*url.Userinfo
+	for k, v := range au.kvs {
+		if isHashedPassword(v) {
+			continue
+		}
+		users = append(users, url.UserPassword(k, v))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username() < users[j].Username()
+	})
+	return users
+}
+
+// Add adds a key-value pair to the Authenticator.
+func (au *LocalAuthenticator) Add(k, v string) {
+	au.mux.Lock()
+	defer au.mux.Unlock()
+
+	au.base[k] = v
+	au.kvs[k] = v
+}
+
+// Reload parses config from r, then live reloads the Authenticator.
+// The config has the same format as the secrets file: one 'user password' pair per line,
+// the htpasswd format 'user:password' is also accepted.
+// The per-user permissions can be appended to the pair as 'whitelist=<permission>' or 'blacklist=<permission>',
+// the permission has the same format as ParsePermissions, and they can be repeated for multiple permissions.
+// The pairs in the config replace the previously reloaded ones.
+func (au *LocalAuthenticator) Reload(r io.Reader) error {
+	var period time.Duration
+	kvs := make(map[string]string)
+	perms := make(map[string]*userPermissions)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line, whitelist, blacklist := splitUserPermissions(line)
+		if line == "" {
+			continue
+		}
+
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) == 1 && strings.Contains(line, ":") { // htpasswd format
+			ss = strings.SplitN(line, ":", 2)
+		}
+		k := strings.TrimSpace(ss[0])
+		var v string
+		if len(ss) == 2 {
+			v = strings.TrimSpace(ss[1])
+		}
+
+		// reload option
+		if strings.ToLower(k) == "reload" && v != "" {
+			period, _ = time.ParseDuration(v)
+			continue
+		}
+
+		kvs[k] = v
+
+		if len(whitelist) == 0 && len(blacklist) == 0 {
+			continue
+		}
+		up := &userPermissions{}
+		if len(whitelist) > 0 {
+			wl, err := ParsePermissions(strings.Join(whitelist, " "))
+			if err != nil {
+				return err
+			}
+			up.whitelist = wl
+		}
+		if len(blacklist) > 0 {
+			bl, err := ParsePermissions(strings.Join(blacklist, " "))
+			if err != nil {
+				return err
+			}
+			up.blacklist = bl
+		}
+		perms[k] = up
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	au.mux.Lock()
+	defer au.mux.Unlock()
+
+	for k, v := range au.base {
+		if _, ok := kvs[k]; !ok {
+			kvs[k] = v
+		}
+	}
+	au.period = period
+	au.kvs = kvs
+	au.perms = perms
+	au.loaded = true
+
+	return nil
+}
+
+// Period returns the reload period.
+func (au *LocalAuthenticator) Period() time.Duration {
+	au.mux.RLock()
+	defer au.mux.RUnlock()
+
+	return au.period
+}
+
+// splitUserPermissions splits the trailing permission fields from the line.
+func splitUserPermissions(line string) (s string, whitelist, blacklist []string) {
+	s = line
+	for s != "" {
+		n := strings.LastIndexAny(s, " \t")
+		field := s[n+1:]
+		switch {
+		case strings.HasPrefix(field, "whitelist="):
+			whitelist = append([]string{strings.TrimPrefix(field, "whitelist=")}, whitelist...)
+		case strings.HasPrefix(field, "blacklist="):
+			blacklist = append([]string{strings.TrimPrefix(field, "blacklist=")}, blacklist...)
+		default:
+			return
+		}
+		if n < 0 {
+			s = ""
+		} else {
+			s = strings.TrimSpace(s[:n])
+		}
+	}
+	return
+}
+
+// isHashedPassword reports whether the stored password is in one of the hash formats.
+func isHashedPassword(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "{SHA}", apr1Magic} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// comparePassword compares the stored (maybe hashed) password with the plaintext password in constant time.
+func comparePassword(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"),
+		strings.HasPrefix(hashed, "$2b$"),
+		strings.HasPrefix(hashed, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hashed, apr1Magic):
+		salt := strings.TrimPrefix(hashed, apr1Magic)
+		if n := strings.IndexByte(salt, '$'); n >= 0 {
+			salt = salt[:n]
+		}
+		password = apr1Crypt(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(password)) == 1
+}
+
+const (
+	apr1Magic = "$apr1$"
+	itoa64    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// apr1Crypt computes the Apache variant of the MD5-crypt password hash.
+func apr1Crypt(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, sl := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(sl)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write(sl)
+	for n := len(pw); n > 0; n -= md5.Size {
+		if n > md5.Size {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(sl)
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	b := make([]byte, 0, 22)
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b = append(b, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	to64(uint(sum[11]), 2)
+
+	return apr1Magic + salt + "$" + string(b)
+}
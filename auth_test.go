@@ -0,0 +1,329 @@
+package gost
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var localAuthenticatorTests = []struct {
+	users    []*url.Userinfo
+	user     string
+	password string
+	ok       bool
+}{
+	{nil, "", "", true},
+	{nil, "admin", "123456", true},
+	{[]*url.Userinfo{url.User("admin")}, "", "", false},
+	{[]*url.Userinfo{url.User("admin")}, "admin", "", true},
+	{[]*url.Userinfo{url.User("admin")}, "admin", "123456", true},
+	{[]*url.Userinfo{url.UserPassword("admin", "123456")}, "admin", "", false},
+	{[]*url.Userinfo{url.UserPassword("admin", "123456")}, "admin", "123456", true},
+	{[]*url.Userinfo{url.UserPassword("admin", "123456")}, "test", "123456", false},
+	{[]*url.Userinfo{url.UserPassword("", "123456")}, "test", "123456", true},
+	{[]*url.Userinfo{url.UserPassword("", "123456")}, "test", "abc", false},
+	{[]*url.Userinfo{url.User("test"), url.UserPassword("admin", "123456")}, "admin", "123456", true},
+}
+
+func TestLocalAuthenticator(t *testing.T) {
+	for i, test := range localAuthenticatorTests {
+		var au Authenticator
+		if len(test.users) > 0 {
+			au = UsersAuthenticator(test.users...)
+		} else {
+			au = NewLocalAuthenticator(nil)
+		}
+		if au.Authenticate(test.user, test.password) != test.ok {
+			t.Errorf("#%d: authenticate %s:%s, want %v", i, test.user, test.password, test.ok)
+		}
+	}
+}
+
+func TestUsersHandlerOption(t *testing.T) {
+	if au := UsersAuthenticator(); au != nil {
+		t.Errorf("got %v, want nil Authenticator", au)
+	}
+
+	users := UsersHandlerOption(url.UserPassword("admin", "123456"))
+	au := NewLocalAuthenticator(map[string]string{"test": "abc"})
+	var tests = []struct {
+		opts []HandlerOption
+		user string
+	}{
+		{[]HandlerOption{users}, "admin"},
+		{[]HandlerOption{users, AuthenticatorHandlerOption(nil)}, "admin"},
+		{[]HandlerOption{AuthenticatorHandlerOption(nil), users}, "admin"},
+		{[]HandlerOption{users, AuthenticatorHandlerOption(au)}, "test"},
+		{[]HandlerOption{AuthenticatorHandlerOption(au), users}, "test"},
+	}
+	for i, test := range tests {
+		h := HTTPHandler(test.opts...).(*httpHandler)
+		if h.options.Authenticator == nil {
+			t.Errorf("#%d: no Authenticator", i)
+			continue
+		}
+		for _, user := range []string{"admin", "test"} {
+			ok := h.options.Authenticator.Authenticate(user, map[string]string{"admin": "123456", "test": "abc"}[user])
+			if ok != (user == test.user) {
+				t.Errorf("#%d: authenticate %s, got %v", i, user, ok)
+			}
+		}
+	}
+
+	if h := HTTPHandler(UsersHandlerOption()).(*httpHandler); h.options.Authenticator != nil {
+		t.Errorf("got %v, want nil Authenticator", h.options.Authenticator)
+	}
+}
+
+func TestLocalAuthenticatorReload(t *testing.T) {
+	au := NewLocalAuthenticator(map[string]string{"admin": "123456"})
+
+	secrets := []byte(`
+# comment
+reload 10s
+test abc
+guest
+`)
+	if err := au.Reload(bytes.NewReader(secrets)); err != nil {
+		t.Fatal(err)
+	}
+	if au.Period().String() != "10s" {
+		t.Errorf("reload period: got %v, want 10s", au.Period())
+	}
+	if !au.Authenticate("admin", "123456") {
+		t.Error("static user should be kept after reload")
+	}
+	if !au.Authenticate("test", "abc") || !au.Authenticate("guest", "any") {
+		t.Error("reloaded users should be authenticated")
+	}
+
+	// revoke the user test
+	if err := au.Reload(bytes.NewReader([]byte("guest\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if au.Authenticate("test", "abc") {
+		t.Error("revoked user should not be authenticated")
+	}
+
+	// the authenticator fails closed after reloading an empty config
+	au = NewLocalAuthenticator(nil)
+	if !au.Authenticate("test", "abc") {
+		t.Error("the authenticator without config should authenticate all the clients")
+	}
+	if err := au.Reload(bytes.NewReader([]byte("# no users\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if au.Authenticate("test", "abc") || au.Authenticate("", "") {
+		t.Error("the authenticator of an empty config should not authenticate any client")
+	}
+}
+
+func TestLocalAuthenticatorUsers(t *testing.T) {
+	au := NewLocalAuthenticator(map[string]string{"admin": "123456"})
+	au.Reload(bytes.NewBufferString("test abc\nguest\nhashed {SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs="))
+
+	var users []string
+	for _, user := range au.Users() {
+		password, _ := user.Password()
+		users = append(users, user.Username()+":"+password)
+	}
+	if s := strings.Join(users, " "); s != "admin:123456 guest: test:abc" {
+		t.Errorf("got users %q", s)
+	}
+}
+
+func TestComparePassword(t *testing.T) {
+	b, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash := string(b)
+	htpasswdHash := "$2y$" + strings.TrimPrefix(bcryptHash, "$2a$")
+
+	tests := []struct {
+		hashed   string
+		password string
+		ok       bool
+	}{
+		{"123456", "123456", true},
+		{"123456", "12345", false},
+		{bcryptHash, "123456", true},
+		{bcryptHash, "654321", false},
+		{htpasswdHash, "123456", true},
+		{"{SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs=", "123456", true},
+		{"{SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs=", "1234567", false},
+		{"$apr1$r31x1y2z$glSwL1RdOXpV/xPuW1YRL1", "myPassword", true},
+		{"$apr1$r31x1y2z$glSwL1RdOXpV/xPuW1YRL1", "mypassword", false},
+	}
+	for _, test := range tests {
+		if comparePassword(test.hashed, test.password) != test.ok {
+			t.Errorf("compare %s with %s, want %v", test.hashed, test.password, test.ok)
+		}
+	}
+}
+
+func TestLocalAuthenticatorHtpasswd(t *testing.T) {
+	au := NewLocalAuthenticator(nil)
+	secrets := "admin:{SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs=\n" +
+		"test $apr1$r31x1y2z$glSwL1RdOXpV/xPuW1YRL1\n"
+	if err := au.Reload(strings.NewReader(secrets)); err != nil {
+		t.Fatal(err)
+	}
+	if !au.Authenticate("admin", "123456") || !au.Authenticate("test", "myPassword") {
+		t.Error("hashed users should be authenticated")
+	}
+	if au.Authenticate("admin", "{SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs=") {
+		t.Error("the hash itself must not be accepted as password")
+	}
+}
+
+func TestLocalAuthenticatorUserPermissions(t *testing.T) {
+	au := NewLocalAuthenticator(nil)
+	secrets := []byte(`
+staff 123456
+contractor abc def whitelist=tcp:*.example.com:443 whitelist=udp:*:53
+guest:{SHA}fEqNCco3Yq9h5ZUglD3CZJT4lBs= blacklist=*:*:25
+`)
+	if err := au.Reload(bytes.NewReader(secrets)); err != nil {
+		t.Fatal(err)
+	}
+	if !au.Authenticate("contractor", "abc def") || !au.Authenticate("guest", "123456") {
+		t.Error("users with permissions should be authenticated")
+	}
+
+	opts := &HandlerOptions{Authenticator: au}
+	var tests = []struct {
+		user   string
+		action string
+		addr   string
+		can    bool
+	}{
+		{"staff", "tcp", "www.google.com:443", true},
+		{"", "tcp", "www.google.com:443", true},
+		{"contractor", "tcp", "www.example.com:443", true},
+		{"contractor", "tcp", "www.example.com:80", false},
+		{"contractor", "tcp", "www.google.com:443", false},
+		{"contractor", "udp", "8.8.8.8:53", true},
+		{"guest", "tcp", "www.google.com:443", true},
+		{"guest", "tcp", "smtp.google.com:25", false},
+	}
+	for i, test := range tests {
+		if can := opts.can(test.action, test.addr, nil, test.user); can != test.can {
+			t.Errorf("#%d: %s %s %s should be %v, got %v", i, test.user, test.action, test.addr, test.can, can)
+		}
+	}
+
+	// the listener permissions are always checked.
+	opts.Blacklist, _ = ParsePermissions("*:www.example.com:*")
+	if opts.can("tcp", "www.example.com:443", nil, "contractor") {
+		t.Error("listener blacklist should be applied")
+	}
+
+	// the permissions are looked up by the identity of the matched entry, not the user name sent by the client.
+	au.Reload(bytes.NewReader([]byte(":shared\nguest\nadmin 123456 blacklist=*:*:*\n")))
+	var identities = []struct {
+		user, password string
+		identity       string
+		ok             bool
+	}{
+		{"admin", "123456", "admin", true},
+		{"admin", "shared", "", true}, // authenticated by the password-only entry
+		{"guest", "", "guest", true},
+		{"admin", "wrong", "", false},
+	}
+	for i, test := range identities {
+		identity, ok := authenticate(au, test.user, test.password)
+		if identity != test.identity || ok != test.ok {
+			t.Errorf("#%d: got %q %v, want %q %v", i, identity, ok, test.identity, test.ok)
+		}
+	}
+	if id, _ := authenticate(au, "admin", "shared"); !opts.can("tcp", "www.google.com:443", nil, id) {
+		t.Error("the client authenticated by the password-only entry should not be bound by the permissions of the user")
+	}
+
+	if err := au.Reload(bytes.NewReader([]byte("contractor abc whitelist=bad\n"))); err == nil {
+		t.Error("invalid permissions should be rejected")
+	}
+}
+
+func TestAuthGuard(t *testing.T) {
+	g := NewAuthGuard(3, time.Minute, time.Minute)
+	_, allow, _ := net.ParseCIDR("10.0.0.0/8")
+	g.Allowlist = []*net.IPNet{allow}
+
+	ip := net.ParseIP("192.168.1.1")
+	g.Fail(ip, "")
+	g.Fail(ip, "")
+	g.Succeed(ip)
+	g.Fail(ip, "")
+	g.Fail(ip, "")
+	if g.Banned(ip) {
+		t.Error("the failures should be reset by the success")
+	}
+	g.Fail(ip, "")
+	if !g.Banned(ip) || g.Banned(nil) {
+		t.Error("only the source IP should be banned")
+	}
+	if g.Banned(net.ParseIP("192.168.1.2")) {
+		t.Error("other source IP should not be banned")
+	}
+	if bans := g.Bans(); len(bans) != 1 || !strings.HasPrefix(bans[0], "192.168.1.1(") {
+		t.Errorf("wrong bans: %v", bans)
+	}
+
+	// the ban time doubles for the subsequent ban.
+	r := g.records["192.168.1.1"]
+	r.until = time.Now()
+	for i := 0; i < 3; i++ {
+		g.Fail(ip, "")
+	}
+	if d := r.until.Sub(time.Now()); d <= time.Minute || d > 2*time.Minute {
+		t.Errorf("the ban time should be doubled, got %v", d)
+	}
+
+	trusted := net.ParseIP("10.1.1.1")
+	for i := 0; i < 5; i++ {
+		g.Fail(trusted, "")
+	}
+	if g.Banned(trusted) {
+		t.Error("the allowlisted source should not be banned")
+	}
+
+	// the IPv6 sources are banned by the /64 networks.
+	ip6 := net.ParseIP("2001:db8::1")
+	for i := 0; i < 3; i++ {
+		g.Fail(ip6, "")
+	}
+	if !g.Banned(net.ParseIP("2001:db8::ffff")) || g.Banned(net.ParseIP("2001:db8:0:1::1")) {
+		t.Error("the /64 network of the IPv6 source should be banned")
+	}
+
+	// the sources are banned at once after too many failures of the user.
+	g = NewAuthGuard(3, time.Minute, time.Minute)
+	g.MaxUserFailures = 4
+	for i := 0; i < 4; i++ {
+		g.Fail(net.IPv4(172, 16, 0, byte(i)), "admin")
+	}
+	if len(g.Bans()) != 0 {
+		t.Errorf("no source should be banned, got %v", g.Bans())
+	}
+	g.Fail(net.IPv4(172, 16, 1, 1), "admin")
+	g.Fail(net.IPv4(172, 16, 1, 2), "guest")
+	if !g.Banned(net.IPv4(172, 16, 1, 1)) || g.Banned(net.IPv4(172, 16, 1, 2)) {
+		t.Errorf("only the source of the user with too many failures should be banned, got %v", g.Bans())
+	}
+	if g.Banned(net.IPv4(172, 16, 1, 3)) {
+		t.Error("the user should not be banned")
+	}
+
+	var nilGuard *AuthGuard
+	nilGuard.Fail(ip, "")
+	if nilGuard.Banned(ip) || nilGuard.Bans() != nil {
+		t.Error("nil guard should not ban")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
@@ -25,11 +26,15 @@ type Matcher interface {
 // The acutal Matcher depends on the pattern:
 // IP Matcher if pattern is a valid IP address.
 // CIDR Matcher if pattern is a valid CIDR address.
-// Domain Matcher if both of the above are not.
+// GeoIP Matcher of the DefaultGeoIP if pattern is 'geoip:' followed by the country code, such as geoip:CN.
+// Domain Matcher if none of the above.
 func NewMatcher(pattern string) Matcher {
 	if pattern == "" {
 		return nil
 	}
+	if strings.HasPrefix(pattern, "geoip:") {
+		return GeoIPMatcher(nil, strings.TrimPrefix(pattern, "geoip:"))
+	}
 	if ip := net.ParseIP(pattern); ip != nil {
 		return IPMatcher(ip)
 	}
@@ -86,21 +91,47 @@ func (m *cidrMatcher) String() string {
 type domainMatcher struct {
 	pattern string
 	glob    glob.Glob
+	kind    domainKind // the kind of the pattern for the domain trie
+	domain  string     // the domain part of the pattern without the wildcard prefix
 }
 
+type domainKind int
+
+const (
+	domainGlob      domainKind = iota // a real glob, it can not be indexed
+	domainExact                       // example.com
+	domainSuffix                      // .example.com, matches the domain and its subdomains
+	domainSubdomain                   // *.example.com, matches the subdomains only
+)
+
 // DomainMatcher creates a Matcher for a specific domain pattern,
 // the pattern can be a plain domain such as 'example.com',
 // a wildcard such as '*.exmaple.com' or a special wildcard '.example.com'.
 func DomainMatcher(pattern string) Matcher {
+	m := &domainMatcher{}
+
+	switch {
+	case strings.HasPrefix(pattern, "."):
+		m.kind, m.domain = domainSuffix, pattern[1:]
+	case strings.HasPrefix(pattern, "**."):
+		m.kind, m.domain = domainSubdomain, pattern[3:]
+	case strings.HasPrefix(pattern, "*."):
+		m.kind, m.domain = domainSubdomain, pattern[2:]
+	default:
+		m.kind, m.domain = domainExact, pattern
+	}
+	if strings.ContainsAny(m.domain, "*?[]{}\\") {
+		m.kind, m.domain = domainGlob, ""
+	}
+
 	p := pattern
 	if strings.HasPrefix(pattern, ".") {
 		p = pattern[1:] // trim the prefix '.'
 		pattern = "*" + pattern
 	}
-	return &domainMatcher{
-		pattern: p,
-		glob:    glob.MustCompile(pattern),
-	}
+	m.pattern = p
+	m.glob = glob.MustCompile(pattern)
+	return m
 }
 
 func (m *domainMatcher) Match(domain string) bool {
@@ -121,10 +152,14 @@ func (m *domainMatcher) String() string {
 // Bypass is a filter for address (IP or domain).
 // It contains a list of matchers.
 type Bypass struct {
-	matchers []Matcher
-	reversed bool
-	period   time.Duration // the period for live reloading
-	mux      sync.Mutex
+	matchers   []Matcher
+	index      *matcherIndex
+	exceptions []Matcher // the exception rules of the AdBlock Plus list
+	exIndex    *matcherIndex
+	reversed   bool
+	geoip      *GeoIP        // the database of the geoip rules
+	period     time.Duration // the period for live reloading
+	mux        sync.RWMutex
 }
 
 // NewBypass creates and initializes a new Bypass using matchers as its match rules.
@@ -132,6 +167,7 @@ type Bypass struct {
 func NewBypass(reversed bool, matchers ...Matcher) *Bypass {
 	return &Bypass{
 		matchers: matchers,
+		index:    newMatcherIndex(matchers...),
 		reversed: reversed,
 	}
 }
@@ -150,6 +186,13 @@ func NewBypassPatterns(reversed bool, patterns ...string) *Bypass {
 
 // Contains reports whether the bypass includes addr.
 func (bp *Bypass) Contains(addr string) bool {
+	return bp.ContainsLookup(addr, nil)
+}
+
+// ContainsLookup reports whether the bypass includes addr,
+// the host of addr is resolved by the lookup function if it is not matched
+// and the bypass has the matchers which only match the IP, such as the geoip matchers.
+func (bp *Bypass) ContainsLookup(addr string, lookup func(host string) []net.IP) bool {
 	if bp == nil {
 		return false
 	}
@@ -160,45 +203,137 @@ func (bp *Bypass) Contains(addr string) bool {
 		}
 	}
 
-	bp.mux.Lock()
-	defer bp.mux.Unlock()
+	bp.mux.RLock()
+	index, exIndex, reversed := bp.index, bp.exIndex, bp.reversed
+	bp.mux.RUnlock()
 
-	var matched bool
-	for _, matcher := range bp.matchers {
-		if matcher == nil {
-			continue
+	var ips []net.IP
+	resolved := false
+	match := func(idx *matcherIndex) bool {
+		if idx == nil {
+			return false
 		}
-		if matcher.Match(addr) {
-			matched = true
-			break
+		if idx.match(addr) {
+			return true
+		}
+		if !idx.resolve || lookup == nil || net.ParseIP(addr) != nil {
+			return false
 		}
+		if !resolved {
+			ips, resolved = lookup(addr), true
+		}
+		for _, ip := range ips {
+			if idx.match(ip.String()) {
+				return true
+			}
+		}
+		return false
 	}
-	return !bp.reversed && matched ||
-		bp.reversed && !matched
+
+	matched := match(index) && !match(exIndex)
+	return !reversed && matched ||
+		reversed && !matched
 }
 
 // AddMatchers appends matchers to the bypass matcher list.
 func (bp *Bypass) AddMatchers(matchers ...Matcher) {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
 	bp.matchers = append(bp.matchers, matchers...)
+	// the index is rebuilt rather than modified, as it may be used by Contains without the lock.
+	bp.index = newMatcherIndex(bp.matchers...)
+}
+
+// SetGeoIP sets the GeoIP database of the geoip rules of the bypass, including the reloaded rules.
+// The geoip rules created by NewMatcher use the DefaultGeoIP if the database is not set.
+func (bp *Bypass) SetGeoIP(db *GeoIP) {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
+	bp.geoip = db
+	bp.matchers = bindGeoIP(bp.matchers, db)
+	bp.index = newMatcherIndex(bp.matchers...)
+}
+
+// bindGeoIP binds the geoip matchers without a database to db.
+func bindGeoIP(matchers []Matcher, db *GeoIP) []Matcher {
+	if db == nil {
+		return matchers
+	}
+	bound := make([]Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		if m, ok := matcher.(*geoipMatcher); ok && m.db == nil {
+			matcher = GeoIPMatcher(db, m.country)
+		}
+		bound = append(bound, matcher)
+	}
+	return bound
 }
 
 // Matchers return the bypass matcher list.
 func (bp *Bypass) Matchers() []Matcher {
+	bp.mux.RLock()
+	defer bp.mux.RUnlock()
+
 	return bp.matchers
 }
 
+// Exceptions return the bypass exception matcher list, the addresses matched by the exceptions are never matched by the bypass.
+func (bp *Bypass) Exceptions() []Matcher {
+	bp.mux.RLock()
+	defer bp.mux.RUnlock()
+
+	return bp.exceptions
+}
+
 // Reversed reports whether the rules of the bypass are reversed.
 func (bp *Bypass) Reversed() bool {
+	bp.mux.RLock()
+	defer bp.mux.RUnlock()
+
 	return bp.reversed
 }
 
 // Reload parses config from r, then live reloads the bypass.
+//
+// The rule lists in the AdBlock Plus or AutoProxy (gfwlist) syntax are also supported,
+// they are detected by the list header (such as '[Adblock Plus 2.0]' or '[AutoProxy 0.2.9]'),
+// the base64 wrapped list (gfwlist), or the 'format adblock' option.
+// The exception rules ('@@' prefix) of the list are the exceptions of the bypass.
 func (bp *Bypass) Reload(r io.Reader) error {
-	var matchers []Matcher
+	var matchers, exceptions []Matcher
 
-	scanner := bufio.NewScanner(r)
+	bp.mux.RLock()
+	period, reversed := bp.period, bp.reversed
+	bp.mux.RUnlock()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b, ok := decodeAdBlockList(data); ok {
+		data = b
+	}
+
+	adblock := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if adblock {
+			if m, exception := parseAdBlockRule(line); m != nil && exception {
+				exceptions = append(exceptions, m)
+			} else if m != nil {
+				matchers = append(matchers, m)
+			}
+			continue
+		}
+		if isAdBlockHeader(line) {
+			adblock = true
+			continue
+		}
+
 		if n := strings.IndexByte(line, '#'); n >= 0 {
 			line = line[:n]
 		}
@@ -217,7 +352,7 @@ func (bp *Bypass) Reload(r io.Reader) error {
 				}
 			}
 			if len(ss) == 2 {
-				bp.period, _ = time.ParseDuration(ss[1])
+				period, _ = time.ParseDuration(ss[1])
 				continue
 			}
 		}
@@ -231,7 +366,16 @@ func (bp *Bypass) Reload(r io.Reader) error {
 				}
 			}
 			if len(ss) == 2 {
-				bp.reversed, _ = strconv.ParseBool(ss[1])
+				reversed, _ = strconv.ParseBool(ss[1])
+				continue
+			}
+		}
+
+		// format option
+		if strings.HasPrefix(line, "format ") {
+			ss := strings.Fields(line)
+			if len(ss) == 2 && (ss[1] == "adblock" || ss[1] == "gfwlist") {
+				adblock = true
 				continue
 			}
 		}
@@ -246,13 +390,25 @@ func (bp *Bypass) Reload(r io.Reader) error {
 	bp.mux.Lock()
 	defer bp.mux.Unlock()
 
+	matchers = bindGeoIP(matchers, bp.geoip)
+	index := newMatcherIndex(matchers...)
+	exIndex := newMatcherIndex(exceptions...)
+
 	bp.matchers = matchers
+	bp.index = index
+	bp.exceptions = exceptions
+	bp.exIndex = exIndex
+	bp.period = period
+	bp.reversed = reversed
 
 	return nil
 }
 
 // Period returns the reload period
 func (bp *Bypass) Period() time.Duration {
+	bp.mux.RLock()
+	defer bp.mux.RUnlock()
+
 	return bp.period
 }
 
@@ -263,5 +419,246 @@ func (bp *Bypass) String() string {
 		b.WriteString(m.String())
 		b.WriteByte('\n')
 	}
+	for _, m := range bp.Exceptions() {
+		b.WriteString("exception " + m.String())
+		b.WriteByte('\n')
+	}
 	return b.String()
 }
+
+// matcherIndex indexes the matchers for fast matching:
+// the domain patterns without glob are indexed by a reversed-label domain trie,
+// the IP and CIDR matchers are indexed by the radix trees,
+// the others (real globs and the custom matchers) are matched one by one.
+type matcherIndex struct {
+	domains  *domainTrie
+	ipv4     *ipRadixTree
+	ipv6     *ipRadixTree
+	fallback []Matcher
+	resolve  bool // the domains need to be resolved for the matchers which only match the IP, such as the geoip matchers
+}
+
+func newMatcherIndex(matchers ...Matcher) *matcherIndex {
+	idx := &matcherIndex{
+		domains: newDomainTrie(),
+		ipv4:    &ipRadixTree{root: &ipRadixNode{}},
+		ipv6:    &ipRadixTree{root: &ipRadixNode{}},
+	}
+	idx.add(matchers...)
+	return idx
+}
+
+func (idx *matcherIndex) add(matchers ...Matcher) {
+	for _, matcher := range matchers {
+		switch m := matcher.(type) {
+		case nil:
+		case *ipMatcher:
+			if m.ip == nil {
+				continue
+			}
+			if ip := m.ip.To4(); ip != nil {
+				idx.ipv4.insert(ip, 8*net.IPv4len)
+			} else {
+				idx.ipv6.insert(m.ip.To16(), 8*net.IPv6len)
+			}
+		case *cidrMatcher:
+			if m.ipNet == nil {
+				continue
+			}
+			ones, bits := m.ipNet.Mask.Size()
+			if ip := m.ipNet.IP.To4(); ip != nil && bits == 8*net.IPv4len {
+				idx.ipv4.insert(ip, ones)
+			} else if bits == 8*net.IPv6len {
+				idx.ipv6.insert(m.ipNet.IP.To16(), ones)
+			} else {
+				idx.fallback = append(idx.fallback, m)
+			}
+		case *domainMatcher:
+			if m.kind == domainGlob {
+				idx.fallback = append(idx.fallback, m)
+				continue
+			}
+			idx.domains.insert(m.domain, m.kind)
+		case *geoipMatcher:
+			idx.fallback = append(idx.fallback, m)
+			idx.resolve = true
+		default:
+			idx.fallback = append(idx.fallback, m)
+		}
+	}
+}
+
+func (idx *matcherIndex) match(addr string) bool {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			if idx.ipv4.contains(ip4) {
+				return true
+			}
+		} else if idx.ipv6.contains(ip) {
+			return true
+		}
+	}
+	if idx.domains.match(addr) {
+		return true
+	}
+	for _, matcher := range idx.fallback {
+		if matcher.Match(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainTrie is a trie of the domain labels in reversed order,
+// such as com -> example -> www for www.example.com.
+type domainTrie struct {
+	root *domainTrieNode
+}
+
+type domainTrieNode struct {
+	children  map[string]*domainTrieNode
+	exact     bool // matches the domain itself
+	subdomain bool // matches the subdomains
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &domainTrieNode{}}
+}
+
+func (t *domainTrie) insert(domain string, kind domainKind) {
+	node := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrieNode)
+			}
+			child = &domainTrieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	switch kind {
+	case domainExact:
+		node.exact = true
+	case domainSuffix:
+		node.exact = true
+		node.subdomain = true
+	case domainSubdomain:
+		node.subdomain = true
+	}
+}
+
+func (t *domainTrie) match(domain string) bool {
+	node := t.root
+	for end := len(domain); ; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		node = node.children[domain[start:end]]
+		if node == nil {
+			return false
+		}
+		if start == 0 { // all labels are consumed
+			return node.exact
+		}
+		if node.subdomain {
+			return true
+		}
+		end = start - 1
+	}
+}
+
+// ipRadixTree is a path compressed binary radix tree of the IP prefixes.
+type ipRadixTree struct {
+	root *ipRadixNode
+}
+
+type ipRadixNode struct {
+	ip       net.IP // the prefix, the bits after the prefix length are zero
+	ones     int    // the prefix length
+	leaf     bool   // the prefix is in the tree
+	children [2]*ipRadixNode
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b, up to max bits.
+func commonPrefixLen(a, b net.IP, max int) int {
+	n := 0
+	for i := 0; n < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			break
+		}
+		n += 8
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+func (t *ipRadixTree) insert(ip net.IP, ones int) {
+	ip = ip.Mask(net.CIDRMask(ones, 8*len(ip)))
+
+	node := t.root
+	for {
+		if node.ones == ones {
+			node.leaf = true
+			return
+		}
+		if node.leaf { // the prefix is covered by a shorter one
+			return
+		}
+
+		b := ipBit(ip, node.ones)
+		child := node.children[b]
+		if child == nil {
+			node.children[b] = &ipRadixNode{ip: ip, ones: ones, leaf: true}
+			return
+		}
+
+		max := child.ones
+		if ones < max {
+			max = ones
+		}
+		n := commonPrefixLen(ip, child.ip, max)
+		if n == child.ones { // the child is a prefix of ip
+			node = child
+			continue
+		}
+
+		// split the child
+		mid := &ipRadixNode{ip: ip.Mask(net.CIDRMask(n, 8*len(ip))), ones: n}
+		mid.children[ipBit(child.ip, n)] = child
+		if n == ones {
+			mid.leaf = true
+		} else {
+			mid.children[ipBit(ip, n)] = &ipRadixNode{ip: ip, ones: ones, leaf: true}
+		}
+		node.children[b] = mid
+		return
+	}
+}
+
+func (t *ipRadixTree) contains(ip net.IP) bool {
+	node := t.root
+	for {
+		if node.leaf {
+			return true
+		}
+		if node.ones >= 8*len(ip) {
+			return false
+		}
+		node = node.children[ipBit(ip, node.ones)]
+		if node == nil || commonPrefixLen(ip, node.ip, node.ones) < node.ones {
+			return false
+		}
+	}
+}
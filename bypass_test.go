@@ -1,6 +1,14 @@
 package gost
 
-import "testing"
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
 
 var bypassTests = []struct {
 	patterns []string
@@ -93,3 +101,200 @@ func TestBypass(t *testing.T) {
 		}
 	}
 }
+
+var bypassIndexTests = []struct {
+	patterns []string
+	addr     string
+	bypassed bool
+}{
+	{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+	{[]string{"2001:db8::/32"}, "2001:db9::1", false},
+	{[]string{"2001:db8::1"}, "2001:db8:0::1", true},
+	{[]string{"::ffff:192.168.1.1"}, "192.168.1.1", true},
+	{[]string{"192.168.1.0/24"}, "::ffff:192.168.1.100", true},
+	{[]string{"10.1.0.0/16", "10.0.0.0/8"}, "10.2.0.1", true},
+	{[]string{"10.0.0.0/8", "10.1.0.0/16"}, "10.2.0.1", true},
+	{[]string{"10.1.2.0/24", "10.1.3.0/24"}, "10.1.4.1", false},
+	{[]string{"10.1.2.0/24", "10.1.3.0/24"}, "10.1.3.1", true},
+	{[]string{".example.com", "*.example.org"}, "example.org", false},
+	{[]string{".example.com", "*.example.org"}, "www.example.org", true},
+	{[]string{"example.com", "*.www.example.com"}, "www.example.com", false},
+	{[]string{"example.com", "*.www.example.com"}, "a.www.example.com", true},
+	{[]string{"example.com", "www.*.com"}, "www.example.com", true},
+	{[]string{"example.com"}, "", false},
+	{[]string{"192.168.1.1"}, "192.168.1.1:8080", true},
+}
+
+func TestBypassIndex(t *testing.T) {
+	for _, test := range bypassIndexTests {
+		bp := NewBypassPatterns(false, test.patterns...)
+		if bp.Contains(test.addr) != test.bypassed {
+			t.Errorf("test failed: %v, %s", test.patterns, test.addr)
+		}
+	}
+}
+
+func TestBypassIndexRandom(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+
+	var patterns []string
+	for i := 0; i < 250; i++ {
+		ip := make(net.IP, net.IPv4len)
+		rand.Read(ip)
+		patterns = append(patterns, fmt.Sprintf("%s/%d", ip, 8+rand.Intn(25)))
+		ip6 := make(net.IP, net.IPv6len)
+		rand.Read(ip6)
+		patterns = append(patterns, fmt.Sprintf("%s/%d", ip6, 16+rand.Intn(113)))
+	}
+	bp := NewBypassPatterns(false, patterns...)
+	bp.AddMatchers(NewMatcher("11.22.33.44"))
+
+	for i := 0; i < 1000; i++ {
+		size := net.IPv4len
+		if i%2 == 1 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		rand.Read(ip)
+		if i%3 == 0 { // make it more likely to hit a rule
+			_, ipNet, _ := net.ParseCIDR(patterns[rand.Intn(len(patterns))])
+			if len(ipNet.IP) == size {
+				copy(ip, ipNet.IP)
+				ip[size-1] = byte(rand.Intn(256))
+			}
+		}
+		if i == 0 {
+			ip = net.ParseIP("11.22.33.44").To4()
+		}
+
+		var matched bool
+		for _, m := range bp.Matchers() {
+			if m.Match(ip.String()) {
+				matched = true
+				break
+			}
+		}
+		if bp.Contains(ip.String()) != matched {
+			t.Fatalf("%s: should be %v", ip, matched)
+		}
+	}
+}
+
+func TestBypassReload(t *testing.T) {
+	bp := NewBypassPatterns(false, "example.com")
+	config := `
+# comment
+reverse true
+reload 10s
+.example.org
+10.0.0.0/8
+`
+	if err := bp.Reload(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	if !bp.Reversed() || bp.Period() != 10*time.Second || len(bp.Matchers()) != 2 {
+		t.Errorf("wrong bypass: %s", bp)
+	}
+	if !bp.Contains("example.com") || bp.Contains("www.example.org") || bp.Contains("10.1.1.1:80") {
+		t.Error("the rules should be reloaded")
+	}
+}
+
+var adBlockRuleTests = []struct {
+	rule      string
+	pattern   string
+	exception bool
+}{
+	{"! comment", "", false},
+	{"[AutoProxy 0.2.9]", "", false},
+	{"||example.com^", ".example.com", false},
+	{"||example.com/path$third-party", ".example.com", false},
+	{"||1.2.3.4:8080", "1.2.3.4", false},
+	{"@@||cn.example.com^", ".cn.example.com", true},
+	{"|http://www.example.org/index.html", "www.example.org", false},
+	{"|https://Example.NET:443/", "example.net", false},
+	{".example.info", ".example.info", false},
+	{"example.io/path", ".example.io", false},
+	{"*.example.dev", "*.example.dev", false},
+	{"keyword", "", false},
+	{"/^https?:\\/\\/[^\\/]+example\\.com/", "", false},
+	{"example.com##.ad", "", false},
+}
+
+func TestParseAdBlockRule(t *testing.T) {
+	for i, test := range adBlockRuleTests {
+		m, exception := parseAdBlockRule(test.rule)
+		if test.pattern == "" {
+			if m != nil {
+				t.Errorf("#%d %s: should be ignored, got %s", i, test.rule, m)
+			}
+			continue
+		}
+		if m == nil || m.String() != NewMatcher(test.pattern).String() || exception != test.exception {
+			t.Errorf("#%d %s: got %v %v, want %s %v", i, test.rule, m, exception, test.pattern, test.exception)
+		}
+	}
+}
+
+func TestBypassReloadRace(t *testing.T) {
+	bp := NewBypassPatterns(false, "example.com")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			bp.Matchers()
+			bp.Exceptions()
+			bp.Reversed()
+			bp.Period()
+			_ = bp.String()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		bp.Reload(strings.NewReader("reverse true\nreload 10s\n.example.org\n"))
+	}
+	<-done
+}
+
+func TestBypassReloadAdBlock(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! Checksum: xxx
+||example.com
+@@||cn.example.com
+|http://www.example.org/
+.example.net
+10.1.1.1
+`
+	for _, data := range []string{
+		list,
+		base64.StdEncoding.EncodeToString([]byte(list)),
+		"format adblock\n" + strings.SplitN(list, "\n", 2)[1],
+	} {
+		bp := NewBypass(false)
+		if err := bp.Reload(strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if len(bp.Matchers()) != 4 || len(bp.Exceptions()) != 1 {
+			t.Errorf("wrong bypass: %s", bp)
+		}
+
+		var tests = []struct {
+			addr     string
+			bypassed bool
+		}{
+			{"example.com", true},
+			{"www.example.com:443", true},
+			{"cn.example.com", false},
+			{"www.cn.example.com", false},
+			{"www.example.org", true},
+			{"example.org", false},
+			{"a.example.net", true},
+			{"10.1.1.1", true},
+			{"example.cn", false},
+		}
+		for _, test := range tests {
+			if bp.Contains(test.addr) != test.bypassed {
+				t.Errorf("%s: bypassed should be %v", test.addr, test.bypassed)
+			}
+		}
+	}
+}
@@ -127,7 +127,9 @@ func (c *Chain) dialWithOptions(addr string, options *ChainOptions) (net.Conn, e
 	if options == nil {
 		options = &ChainOptions{}
 	}
-	route, err := c.selectRouteFor(addr)
+	route, err := c.selectRouteFor(addr, func(host string) []net.IP {
+		return lookupIP(host, options.Hosts, options.Resolver)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -151,23 +153,16 @@ func (c *Chain) dialWithOptions(addr string, options *ChainOptions) (net.Conn, e
 	return cc, nil
 }
 
+// resolve resolves the host of addr by the hosts and the resolver,
+// the first address is used, which honours the address family preference and the rotation of the resolver.
 func (c *Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return addr
 	}
 
-	if ip := hosts.Lookup(host); ip != nil {
-		return net.JoinHostPort(ip.String(), port)
-	}
-	if resolver != nil {
-		ips, err := resolver.Resolve(host)
-		if err != nil {
-			log.Logf("[resolver] %s: %v", host, err)
-		}
-		if len(ips) > 0 {
-			return net.JoinHostPort(ips[0].String(), port)
-		}
+	if ips := lookupIP(host, hosts, resolver); len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port)
 	}
 	return addr
 }
@@ -284,8 +279,9 @@ func (c *Chain) selectRoute() (route *Chain, err error) {
 	return
 }
 
-// selectRouteFor selects route with bypass testing.
-func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
+// selectRouteFor selects route with bypass testing,
+// the lookup function is used to resolve the host of addr for the geoip rules of the bypass.
+func (c *Chain) selectRouteFor(addr string, lookup func(host string) []net.IP) (route *Chain, err error) {
 	if c.IsEmpty() || c.isRoute {
 		return c, nil
 	}
@@ -300,7 +296,7 @@ func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
 			return
 		}
 
-		if node.Bypass.Contains(addr) {
+		if node.Bypass.ContainsLookup(addr, lookup) {
 			if Debug {
 				buf.WriteString(fmt.Sprintf("[bypass]%s -> %s", node.String(), addr))
 				log.Log("[route]", buf.String())
@@ -125,6 +125,7 @@ type HandshakeOptions struct {
 	WSOptions  *WSOptions
 	KCPConfig  *KCPConfig
 	QUICConfig *QUICConfig
+	SSHConfig  *SSHConfig
 }
 
 // HandshakeOption allows a common way to set handshake options.
@@ -193,6 +194,13 @@ func KCPConfigHandshakeOption(config *KCPConfig) HandshakeOption {
 	}
 }
 
+// SSHConfigHandshakeOption specifies the SSH config used by SSH handshake
+func SSHConfigHandshakeOption(config *SSHConfig) HandshakeOption {
+	return func(opts *HandshakeOptions) {
+		opts.SSHConfig = config
+	}
+}
+
 // QUICConfigHandshakeOption specifies the QUIC config used by QUIC handshake
 func QUICConfigHandshakeOption(config *QUICConfig) HandshakeOption {
 	return func(opts *HandshakeOptions) {
@@ -8,12 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/ginuerzh/gost"
+	"github.com/go-log/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
@@ -135,6 +139,140 @@ func parseUsers(authFile string) (users []*url.Userinfo, err error) {
 	return
 }
 
+// parseAuthenticator creates an Authenticator from the secrets file and the node user.
+// The secrets file will be live reloaded, and the node user is always kept.
+func parseAuthenticator(authFile string, user *url.Userinfo) (gost.Authenticator, error) {
+	if authFile == "" {
+		if user == nil {
+			return nil, nil
+		}
+		return gost.UsersAuthenticator(user), nil
+	}
+
+	au := gost.NewLocalAuthenticator(nil)
+	if user != nil {
+		password, _ := user.Password()
+		au.Add(user.Username(), password)
+	}
+
+	f, err := os.Open(authFile)
+	if err != nil {
+		return nil, err
+	}
+	err = au.Reload(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	go gost.PeriodReload(au, authFile)
+
+	return au, nil
+}
+
+// parseSSHClientConfig creates the SSH client config from the private key file and the host key verification options.
+// The fingerprint takes precedence over the known_hosts file.
+func parseSSHClientConfig(keyFile, passphrase, knownHostsFile, fingerprint string) (*gost.SSHConfig, error) {
+	config := &gost.SSHConfig{}
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if passphrase != "" {
+			config.Key, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		} else {
+			config.Key, err = ssh.ParsePrivateKey(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if fingerprint != "" {
+		config.HostKeyCallback = gost.SSHFingerprintHostKeyCallback(fingerprint)
+	} else if knownHostsFile != "" {
+		cb, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback = cb
+	}
+
+	return config, nil
+}
+
+func parseSSHAuthorizedKeys(authKeysFile string) (map[string]string, error) {
+	if authKeysFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(authKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	return gost.ParseSSHAuthorizedKeys(data)
+}
+
+// parsePermissions parses the permissions from the s,
+// the s can be a file which contains the permissions, the file will be live reloaded.
+func parsePermissions(s string) (*gost.Permissions, error) {
+	if s == "" {
+		return nil, nil
+	}
+	f, err := os.Open(s)
+	if err != nil {
+		return gost.ParsePermissions(s)
+	}
+	defer f.Close()
+
+	perms := &gost.Permissions{}
+	pr := gost.NewPermissionsReloader(perms)
+	if err := pr.Reload(f); err != nil {
+		return nil, err
+	}
+	go gost.PeriodReload(pr, s)
+
+	return perms, nil
+}
+
+// parseAuthGuard creates the AuthGuard from the node options,
+// it returns nil if the maxfails option is not set.
+func parseAuthGuard(node gost.Node) (*gost.AuthGuard, error) {
+	maxFails := node.GetInt("maxfails")
+	if maxFails <= 0 {
+		return nil, nil
+	}
+	window := time.Duration(node.GetInt("failwindow")) * time.Second
+	if window <= 0 {
+		window = time.Minute
+	}
+	banTime := time.Duration(node.GetInt("bantime")) * time.Second
+	if banTime <= 0 {
+		banTime = 5 * time.Minute
+	}
+	guard := gost.NewAuthGuard(maxFails, window, banTime)
+	guard.MaxUserFailures = node.GetInt("maxuserfails")
+
+	for _, s := range strings.Split(node.Get("banallow"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		guard.Allowlist = append(guard.Allowlist, ipNet)
+	}
+	return guard, nil
+}
+
 func parseIP(s string, port string) (ips []string) {
 	if s == "" {
 		return
@@ -222,7 +360,8 @@ func parseStrategy(s string) gost.Strategy {
 	}
 }
 
-func parseBypass(s string) *gost.Bypass {
+// parseBypass creates the bypass of the node, the geoip rules are matched against the GeoIP database db.
+func parseBypass(s string, db *gost.GeoIP) *gost.Bypass {
 	if s == "" {
 		return nil
 	}
@@ -242,17 +381,68 @@ func parseBypass(s string) *gost.Bypass {
 			}
 			matchers = append(matchers, gost.NewMatcher(s))
 		}
-		return gost.NewBypass(reversed, matchers...)
+		bp := gost.NewBypass(reversed, matchers...)
+		bp.SetGeoIP(db)
+		return bp
 	}
 	f.Close()
 
 	bp := gost.NewBypass(reversed)
+	bp.SetGeoIP(db)
 	go gost.PeriodReload(bp, s)
 
 	return bp
 }
 
-func parseResolver(cfg string) gost.Resolver {
+var geoIPs = make(map[string]*gost.GeoIP)
+
+// parseGeoIP loads the GeoIP database file for the geoip rules of the bypass of the node,
+// the database of the same file is shared by the nodes and reloaded when the file changes.
+func parseGeoIP(s string) *gost.GeoIP {
+	if s == "" {
+		return nil
+	}
+	if db := geoIPs[s]; db != nil {
+		return db
+	}
+	if _, err := os.Stat(s); err != nil {
+		log.Log("[geoip]", err)
+		return nil
+	}
+
+	db := gost.NewGeoIP(time.Minute)
+	geoIPs[s] = db
+	go gost.PeriodReload(db, s)
+	return db
+}
+
+// parseFakeIP creates the fake IP table of the pool.
+// The mappings are loaded from the file and saved to it periodically if the file is not empty.
+func parseFakeIP(pool string, size int, file string) *gost.FakeIP {
+	if pool == "" {
+		return nil
+	}
+
+	f, err := gost.NewFakeIP(pool, size)
+	if err != nil {
+		log.Log("[fakeip]", err)
+		return nil
+	}
+	if file != "" {
+		if fp, err := os.Open(file); err == nil {
+			if err := f.Load(fp); err != nil {
+				log.Log("[fakeip]", err)
+			}
+			fp.Close()
+		}
+		go f.PeriodSave(file, time.Minute)
+	}
+	return f
+}
+
+// parseResolver creates the resolver from the name server list or the config file,
+// the queries to the name servers are sent through the chain, or directly if the chain is nil.
+func parseResolver(cfg string, chain *gost.Chain) gost.Resolver {
 	if cfg == "" {
 		return nil
 	}
@@ -267,24 +457,26 @@ func parseResolver(cfg string) gost.Resolver {
 			if s == "" {
 				continue
 			}
-			ss := strings.Split(s, "/")
-			if len(ss) == 1 {
-				nss = append(nss, gost.NameServer{
-					Addr: ss[0],
-				})
+			// address[/protocol[/hostname]][|option=value...], or the URL of the DNS-over-HTTPS server[|option=value...],
+			// the options are separated by '|', as the values (such as the ca file and the pin) may contain '/'.
+			fields := strings.Split(s, "|")
+			ss := []string{fields[0]}
+			if !strings.HasPrefix(strings.ToLower(fields[0]), "https://") {
+				ss = strings.Split(fields[0], "/")
 			}
-			if len(ss) == 2 {
-				nss = append(nss, gost.NameServer{
-					Addr:     ss[0],
-					Protocol: ss[1],
-				})
+			ss = append(ss, fields[1:]...)
+			ns, err := gost.ParseNameServer(ss...)
+			if err != nil {
+				log.Logf("[resolver] %s: %v", s, err)
+				continue
 			}
+			nss = append(nss, ns)
 		}
-		return gost.NewResolver(timeout, ttl, nss...)
+		return gost.NewChainResolver(chain, timeout, ttl, nss...)
 	}
 	f.Close()
 
-	resolver := gost.NewResolver(timeout, ttl)
+	resolver := gost.NewChainResolver(chain, timeout, ttl)
 	go gost.PeriodReload(resolver, cfg)
 
 	return resolver
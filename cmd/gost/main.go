@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	// _ "net/http/pprof"
+	"net/url"
 	"os"
 	"runtime"
 	"time"
@@ -195,12 +196,29 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		InsecureSkipVerify: !node.GetBool("secure"),
 		RootCAs:            rootCAs,
 	}
+	// client certificate for the server which requires the client authentication.
+	if certFile, keyFile := node.Get("cert"), node.Get("key"); certFile != "" && keyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
 	wsOpts := &gost.WSOptions{}
 	wsOpts.EnableCompression = node.GetBool("compression")
 	wsOpts.ReadBufferSize = node.GetInt("rbuf")
 	wsOpts.WriteBufferSize = node.GetInt("wbuf")
 	wsOpts.UserAgent = node.Get("agent")
 
+	var sshConfig *gost.SSHConfig
+	if node.Transport == "ssh" {
+		sshConfig, err = parseSSHClientConfig(node.Get("privkey"), node.Get("passphrase"),
+			node.Get("knownhosts"), node.Get("fingerprint"))
+		if err != nil {
+			return
+		}
+	}
+
 	var tr gost.Transporter
 	switch node.Transport {
 	case "tls":
@@ -293,6 +311,7 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		gost.HostHandshakeOption(node.Host),
 		gost.UserHandshakeOption(node.User),
 		gost.TLSConfigHandshakeOption(tlsCfg),
+		gost.SSHConfigHandshakeOption(sshConfig),
 		gost.IntervalHandshakeOption(time.Duration(node.GetInt("ping")) * time.Second),
 		gost.TimeoutHandshakeOption(time.Duration(timeout) * time.Second),
 		gost.RetryHandshakeOption(node.GetInt("retry")),
@@ -302,7 +321,7 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		Transporter: tr,
 	}
 
-	node.Bypass = parseBypass(node.Get("bypass"))
+	node.Bypass = parseBypass(node.Get("bypass"), parseGeoIP(node.Get("geoip")))
 
 	ips := parseIP(node.Get("ip"), sport)
 	for _, ip := range ips {
@@ -334,23 +353,48 @@ func (r *route) serve() error {
 		return err
 	}
 
+	// the fake IP tables are shared by the nodes of the route with the same pool,
+	// such as the DNS server and the redirect server.
+	fakeIPs := make(map[string]*gost.FakeIP)
+
 	for _, ns := range r.ServeNodes {
 		node, err := gost.ParseNode(ns)
 		if err != nil {
 			return err
 		}
-		users, err := parseUsers(node.Get("secrets"))
+		var users []*url.Userinfo
+		if node.User != nil {
+			users = append(users, node.User)
+		}
+		authenticator, err := parseAuthenticator(node.Get("secrets"), node.User)
+		if err != nil {
+			return err
+		}
+		authorizedKeys, err := parseSSHAuthorizedKeys(node.Get("authkeys"))
 		if err != nil {
 			return err
 		}
-		if node.User != nil {
-			users = append(users, node.User)
+		authGuard, err := parseAuthGuard(node)
+		if err != nil {
+			return err
 		}
 		certFile, keyFile := node.Get("cert"), node.Get("key")
 		tlsCfg, err := tlsConfig(certFile, keyFile)
 		if err != nil && certFile != "" && keyFile != "" {
 			return err
 		}
+		clientCAs, err := loadCA(node.Get("clientca"))
+		if err != nil {
+			return err
+		}
+		// require and verify the client certificates.
+		if clientCAs != nil {
+			if tlsCfg == nil {
+				tlsCfg = &tls.Config{Certificates: gost.DefaultTLSConfig.Certificates}
+			}
+			tlsCfg.ClientCAs = clientCAs
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 
 		wsOpts := &gost.WSOptions{}
 		wsOpts.EnableCompression = node.GetBool("compression")
@@ -380,8 +424,10 @@ func (r *route) serve() error {
 			ln, err = gost.KCPListener(node.Addr, config)
 		case "ssh":
 			config := &gost.SSHConfig{
-				Users:     users,
-				TLSConfig: tlsCfg,
+				Authenticator:  authenticator,
+				AuthorizedKeys: authorizedKeys,
+				AuthGuard:      authGuard,
+				TLSConfig:      tlsCfg,
 			}
 			if node.Protocol == "forward" {
 				ln, err = gost.TCPListener(node.Addr)
@@ -434,6 +480,8 @@ func (r *route) serve() error {
 			ln, err = gost.Obfs4Listener(node.Addr)
 		case "ohttp":
 			ln, err = gost.ObfsHTTPListener(node.Addr)
+		case "dns":
+			ln, err = gost.DNSListener(node.Addr)
 		default:
 			ln, err = gost.TCPListener(node.Addr)
 		}
@@ -469,6 +517,8 @@ func (r *route) serve() error {
 			handler = gost.ShadowUDPdHandler()
 		case "sni":
 			handler = gost.SNIHandler()
+		case "dns":
+			handler = gost.DNSHandler()
 		default:
 			// start from 2.5, if remote is not empty, then we assume that it is a forward tunnel.
 			if node.Remote != "" {
@@ -478,18 +528,17 @@ func (r *route) serve() error {
 			}
 		}
 
-		var whitelist, blacklist *gost.Permissions
-		if node.Values.Get("whitelist") != "" {
-			if whitelist, err = gost.ParsePermissions(node.Get("whitelist")); err != nil {
-				return err
-			}
+		whitelist, err := parsePermissions(node.Get("whitelist"))
+		if err != nil {
+			return err
 		}
-		if node.Values.Get("blacklist") != "" {
-			if blacklist, err = gost.ParsePermissions(node.Get("blacklist")); err != nil {
-				return err
-			}
+		blacklist, err := parsePermissions(node.Get("blacklist"))
+		if err != nil {
+			return err
 		}
 
+		geoip := parseGeoIP(node.Get("geoip"))
+
 		var hosts *gost.Hosts
 		if f, _ := os.Open(node.Get("hosts")); f != nil {
 			f.Close()
@@ -497,19 +546,46 @@ func (r *route) serve() error {
 			go gost.PeriodReload(hosts, node.Get("hosts"))
 		}
 
+		// the queries to the name servers are sent through the chain, unless the dnschain option is false.
+		dnsChain := chain
+		if node.Get("dnschain") != "" && !node.GetBool("dnschain") {
+			dnsChain = nil
+		}
+
+		fakeIP := fakeIPs[node.Get("fakeip")]
+		if fakeIP == nil {
+			fakeIP = parseFakeIP(node.Get("fakeip"), node.GetInt("fakeipsize"), node.Get("fakeipfile"))
+			if fakeIP != nil {
+				fakeIPs[node.Get("fakeip")] = fakeIP
+			}
+		}
+
+		var reverseProxy *gost.ReverseProxy
+		if f, _ := os.Open(node.Get("reverse")); f != nil {
+			f.Close()
+			reverseProxy = gost.NewReverseProxy()
+			go gost.PeriodReload(reverseProxy, node.Get("reverse"))
+		}
+
 		handler.Init(
 			gost.AddrHandlerOption(node.Addr),
 			gost.ChainHandlerOption(chain),
 			gost.UsersHandlerOption(users...),
+			gost.AuthenticatorHandlerOption(authenticator),
+			gost.AuthorizedKeysHandlerOption(authorizedKeys),
+			gost.AuthGuardHandlerOption(authGuard),
 			gost.TLSConfigHandlerOption(tlsCfg),
 			gost.WhitelistHandlerOption(whitelist),
 			gost.BlacklistHandlerOption(blacklist),
-			gost.BypassHandlerOption(parseBypass(node.Get("bypass"))),
+			gost.BypassHandlerOption(parseBypass(node.Get("bypass"), geoip)),
 			gost.StrategyHandlerOption(parseStrategy(node.Get("strategy"))),
-			gost.ResolverHandlerOption(parseResolver(node.Get("dns"))),
+			gost.ResolverHandlerOption(parseResolver(node.Get("dns"), dnsChain)),
 			gost.HostsHandlerOption(hosts),
+			gost.FakeIPHandlerOption(fakeIP),
+			gost.ReverseProxyHandlerOption(reverseProxy),
 			gost.RetryHandlerOption(node.GetInt("retry")),
 			gost.TimeoutHandlerOption(time.Duration(node.GetInt("timeout"))*time.Second),
+			gost.IdleTimeoutHandlerOption(time.Duration(node.GetInt("idletimeout"))*time.Second),
 		)
 
 		srv := &gost.Server{Listener: ln}
@@ -0,0 +1,594 @@
+package gost
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsMinUDPSize     = 512
+	dnsTCPIdleTimeout = 30 * time.Second
+	dnsTypeSOA        = 6
+	dnsTypeOPT        = 41
+)
+
+var (
+	errDNSInvalidMessage = errors.New("dns: invalid message")
+)
+
+type dnsListener struct {
+	ln       net.Listener
+	pc       net.PacketConn
+	connChan chan net.Conn
+	errChan  chan error
+	closeMux sync.Mutex
+	closed   bool
+}
+
+// DNSListener creates a Listener for DNS server, it accepts the DNS queries on both UDP and TCP.
+// Each UDP query is accepted as a connection which can be read once.
+func DNSListener(addr string) (Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	l := &dnsListener{
+		ln:       ln,
+		pc:       pc,
+		connChan: make(chan net.Conn, 1024),
+		errChan:  make(chan error, 2),
+	}
+	go l.udpLoop()
+	go l.tcpLoop()
+
+	return l, nil
+}
+
+func (l *dnsListener) udpLoop() {
+	for {
+		b := make([]byte, mediumBufferSize)
+		n, raddr, err := l.pc.ReadFrom(b)
+		if err != nil {
+			l.errChan <- err
+			return
+		}
+
+		select {
+		case l.connChan <- &dnsPacketConn{pc: l.pc, raddr: raddr, msg: b[:n]}:
+		default:
+			log.Logf("[dns] %s - %s: connection queue is full", raddr, l.Addr())
+		}
+	}
+}
+
+func (l *dnsListener) tcpLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.errChan <- err
+			return
+		}
+		l.connChan <- conn
+	}
+}
+
+func (l *dnsListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-l.connChan:
+	case err = <-l.errChan:
+		l.Close()
+	}
+	return
+}
+
+func (l *dnsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *dnsListener) Close() error {
+	l.closeMux.Lock()
+	defer l.closeMux.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.pc.Close()
+	return l.ln.Close()
+}
+
+// dnsPacketConn is a UDP DNS query accepted by the DNS listener,
+// the query message can be read once, and the reply is sent back to the client.
+type dnsPacketConn struct {
+	pc    net.PacketConn
+	raddr net.Addr
+	msg   []byte
+}
+
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	if c.msg == nil {
+		return 0, io.EOF
+	}
+	n := copy(b, c.msg)
+	c.msg = nil
+	return n, nil
+}
+
+func (c *dnsPacketConn) Write(b []byte) (int, error) {
+	return c.pc.WriteTo(b, c.raddr)
+}
+
+func (c *dnsPacketConn) Close() error {
+	return nil
+}
+
+func (c *dnsPacketConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *dnsPacketConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *dnsPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dnsPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dnsPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type dnsHandler struct {
+	options *HandlerOptions
+}
+
+// DNSHandler creates a server Handler for DNS server.
+// The queries are checked against the Whitelist and Blacklist by the client address and the queried name (as name:53),
+// then they are answered by the Hosts first, then by the Resolver.
+// If the FakeIP option is set, the A queries are answered with the fake addresses instead of the Resolver.
+// All types of queries are forwarded to the name servers if the Resolver is an Exchanger,
+// otherwise only the A and AAAA queries are answered.
+func DNSHandler(opts ...HandlerOption) Handler {
+	h := &dnsHandler{}
+	h.Init(opts...)
+
+	return h
+}
+
+func (h *dnsHandler) Init(options ...HandlerOption) {
+	if h.options == nil {
+		h.options = &HandlerOptions{}
+	}
+
+	for _, opt := range options {
+		opt(h.options)
+	}
+}
+
+func (h *dnsHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	if _, ok := conn.(*dnsPacketConn); ok {
+		b := make([]byte, mediumBufferSize)
+		n, err := conn.Read(b)
+		if err != nil {
+			return
+		}
+		reply := h.exchange(conn, b[:n])
+		if reply == nil {
+			return
+		}
+		if size := dnsUDPSize(b[:n]); len(reply) > size {
+			reply = dnsTruncate(reply)
+		}
+		if _, err := conn.Write(reply); err != nil {
+			log.Logf("[dns] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		}
+		return
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		reply := h.exchange(conn, query)
+		if reply == nil {
+			return
+		}
+		if err := writeDNSMessage(conn, reply); err != nil {
+			log.Logf("[dns] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			return
+		}
+	}
+}
+
+// exchange answers the query, it returns nil if the query is invalid and should be dropped.
+func (h *dnsHandler) exchange(conn net.Conn, query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		log.Logf("[dns] %s - %s : invalid query", conn.RemoteAddr(), conn.LocalAddr())
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsReply(hdr, nil, dnsmessage.RCodeFormatError)
+	}
+	if hdr.OpCode != 0 {
+		return dnsReply(hdr, &q, dnsmessage.RCodeNotImplemented)
+	}
+
+	if Debug {
+		log.Logf("[dns] %s - %s : %s %s", conn.RemoteAddr(), conn.LocalAddr(), q.Name, dnsTypeString(q.Type))
+	}
+
+	name := strings.TrimSuffix(q.Name, ".")
+
+	// the whitelist and blacklist of the listener are checked against the client and the queried name.
+	action := "tcp"
+	if _, ok := conn.(*dnsPacketConn); ok {
+		action = "udp"
+	}
+	host := name
+	if host == "" {
+		host = "." // the root
+	}
+	if !h.options.can(action, net.JoinHostPort(host, "53"), conn.RemoteAddr(), "") {
+		log.Logf("[dns] %s - %s : %s refused", conn.RemoteAddr(), conn.LocalAddr(), q.Name)
+		return dnsReply(hdr, &q, dnsmessage.RCodeRefused)
+	}
+
+	isIP := (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) && q.Class == dnsmessage.ClassINET
+	if isIP {
+		if ips := h.options.Hosts.LookupIPs(name); len(ips) > 0 {
+			if Debug {
+				log.Logf("[dns] %s - %s : hosts %s %v", conn.RemoteAddr(), conn.LocalAddr(), name, ips)
+			}
+			return dnsReplyIPs(hdr, q, ips, uint32(DefaultResolverTTL/time.Second))
+		}
+	}
+
+	if isIP && h.options.FakeIP != nil {
+		// the AAAA queries have no answer, so the clients connect to the fake IPv4 address.
+		var ips []net.IP
+		if q.Type == dnsmessage.TypeA {
+			ips = append(ips, h.options.FakeIP.Lookup(name))
+		}
+		if Debug {
+			log.Logf("[dns] %s - %s : fake IP %s %v", conn.RemoteAddr(), conn.LocalAddr(), name, ips)
+		}
+		return dnsReplyIPs(hdr, q, ips, fakeIPTTL)
+	}
+
+	timeout := h.options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultResolverTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if ex, ok := h.options.Resolver.(Exchanger); ok {
+		reply, err := ex.Exchange(ctx, query)
+		if err != nil {
+			log.Logf("[dns] %s - %s : %s %s", conn.RemoteAddr(), conn.LocalAddr(), q.Name, err)
+			return dnsReply(hdr, &q, dnsmessage.RCodeServerFailure)
+		}
+		return reply
+	}
+
+	if !isIP {
+		return dnsReply(hdr, &q, dnsmessage.RCodeNotImplemented)
+	}
+
+	var ips []net.IP
+	if h.options.Resolver != nil {
+		ips, err = h.options.Resolver.Resolve(name)
+	} else {
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, name)
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if err != nil {
+		log.Logf("[dns] %s - %s : %s %s", conn.RemoteAddr(), conn.LocalAddr(), q.Name, err)
+		return dnsReply(hdr, &q, dnsmessage.RCodeServerFailure)
+	}
+	return dnsReplyIPs(hdr, q, ips, uint32(DefaultResolverTTL/time.Second))
+}
+
+// dnsReply creates an empty reply message for the query with the rcode.
+func dnsReply(hdr dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			OpCode:             hdr.OpCode,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+	}
+	if q != nil {
+		m.Questions = []dnsmessage.Question{*q}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// dnsReplyIPs creates a reply message for the A or AAAA query,
+// only the IPs of the queried address family are in the answers.
+func dnsReplyIPs(hdr dnsmessage.Header, q dnsmessage.Question, ips []net.IP, ttl uint32) []byte {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	rh := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Class: q.Class,
+		TTL:   ttl,
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.Type == dnsmessage.TypeA {
+				r := &dnsmessage.AResource{ResourceHeader: rh}
+				copy(r.A[:], ip4)
+				m.Answers = append(m.Answers, r)
+			}
+			continue
+		}
+		if ip16 := ip.To16(); ip16 != nil && q.Type == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{ResourceHeader: rh}
+			copy(r.AAAA[:], ip16)
+			m.Answers = append(m.Answers, r)
+		}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func dnsTypeString(t dnsmessage.Type) string {
+	switch t {
+	case dnsmessage.TypeA:
+		return "A"
+	case dnsmessage.TypeAAAA:
+		return "AAAA"
+	case dnsmessage.TypeCNAME:
+		return "CNAME"
+	case dnsmessage.TypeMX:
+		return "MX"
+	case dnsmessage.TypeTXT:
+		return "TXT"
+	case dnsmessage.TypeNS:
+		return "NS"
+	case dnsmessage.TypePTR:
+		return "PTR"
+	case dnsmessage.TypeSOA:
+		return "SOA"
+	case dnsmessage.TypeSRV:
+		return "SRV"
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// readDNSMessage reads a DNS message in the TCP format (with the two bytes length prefix).
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, int(l[0])<<8|int(l[1]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeDNSMessage writes a DNS message in the TCP format (with the two bytes length prefix).
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errDNSInvalidMessage
+	}
+	_, err := w.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	return err
+}
+
+// dnsSkipName returns the offset after the domain name at off.
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSInvalidMessage
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, nil
+			}
+			off += c + 1
+		case 0xC0:
+			return off + 2, nil
+		default:
+			return 0, errDNSInvalidMessage
+		}
+	}
+}
+
+// dnsQuestionsEnd returns the offset after the question section.
+func dnsQuestionsEnd(msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, errDNSInvalidMessage
+	}
+	off := 12
+	for i := 0; i < int(msg[4])<<8|int(msg[5]); i++ {
+		var err error
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return 0, err
+		}
+		off += 4 // type and class
+	}
+	if off > len(msg) {
+		return 0, errDNSInvalidMessage
+	}
+	return off, nil
+}
+
+// dnsWalkRecords calls fn for each resource record of the message,
+// with the section (1 for answer, 2 for authority, 3 for additional), the record type and the offset of the record TTL.
+func dnsWalkRecords(msg []byte, fn func(section int, typ uint16, ttlOff int)) error {
+	off, err := dnsQuestionsEnd(msg)
+	if err != nil {
+		return err
+	}
+	for section := 1; section <= 3; section++ {
+		count := int(msg[4+2*section])<<8 | int(msg[5+2*section])
+		for i := 0; i < count; i++ {
+			if off, err = dnsSkipName(msg, off); err != nil {
+				return err
+			}
+			if off+10 > len(msg) {
+				return errDNSInvalidMessage
+			}
+			typ := uint16(msg[off])<<8 | uint16(msg[off+1])
+			rdlen := int(msg[off+8])<<8 | int(msg[off+9])
+			fn(section, typ, off+4)
+			off += 10 + rdlen
+			if off > len(msg) {
+				return errDNSInvalidMessage
+			}
+		}
+	}
+	return nil
+}
+
+func dnsGetTTL(msg []byte, off int) uint32 {
+	return uint32(msg[off])<<24 | uint32(msg[off+1])<<16 | uint32(msg[off+2])<<8 | uint32(msg[off+3])
+}
+
+func dnsSetTTL(msg []byte, off int, ttl uint32) {
+	msg[off], msg[off+1], msg[off+2], msg[off+3] = byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl)
+}
+
+// dnsCacheTTL returns the TTL to cache the reply for, it is the minimum TTL of the answers for the successful reply,
+// or the negative caching TTL (RFC 2308) from the SOA record in the authority section for the NXDOMAIN or NODATA reply.
+// ok is false if the reply should not be cached, such as the truncated or failed reply, or the negative reply without SOA.
+func dnsCacheTTL(msg []byte) (ttl uint32, ok bool) {
+	if len(msg) < 12 || msg[2]&0x02 != 0 {
+		return 0, false
+	}
+	rcode := msg[3] & 0x0f
+	if rcode != 0 && rcode != 3 {
+		return 0, false
+	}
+	negative := rcode == 3 || (msg[6] == 0 && msg[7] == 0)
+
+	err := dnsWalkRecords(msg, func(section int, typ uint16, off int) {
+		var v uint32
+		switch {
+		case !negative && section == 1:
+			v = dnsGetTTL(msg, off)
+		case negative && section == 2 && typ == dnsTypeSOA:
+			// the MINIMUM field is the last four bytes of the SOA RDATA.
+			rdlen := int(msg[off+4])<<8 | int(msg[off+5])
+			end := off + 6 + rdlen
+			if rdlen < 22 || end > len(msg) {
+				return
+			}
+			v = dnsGetTTL(msg, off)
+			if min := dnsGetTTL(msg, end-4); min < v {
+				v = min
+			}
+		default:
+			return
+		}
+		if !ok || v < ttl {
+			ttl, ok = v, true
+		}
+	})
+	if err != nil {
+		return 0, false
+	}
+	return
+}
+
+// dnsDecreaseTTL decreases the TTLs of the records by d seconds.
+func dnsDecreaseTTL(msg []byte, d uint32) {
+	dnsWalkRecords(msg, func(section int, typ uint16, off int) {
+		if typ == dnsTypeOPT {
+			return
+		}
+		ttl := dnsGetTTL(msg, off)
+		if ttl > d {
+			ttl -= d
+		} else {
+			ttl = 0
+		}
+		dnsSetTTL(msg, off, ttl)
+	})
+}
+
+// dnsUDPSize returns the max UDP message size of the query, set by the EDNS0 OPT record.
+func dnsUDPSize(query []byte) int {
+	size := dnsMinUDPSize
+	dnsWalkRecords(query, func(section int, typ uint16, off int) {
+		if section == 3 && typ == dnsTypeOPT {
+			// the class of the OPT record is the UDP payload size
+			if v := int(query[off-2])<<8 | int(query[off-1]); v > size {
+				size = v
+			}
+		}
+	})
+	return size
+}
+
+// dnsTruncate truncates the reply to the header and the question section with the TC bit set.
+func dnsTruncate(reply []byte) []byte {
+	off, err := dnsQuestionsEnd(reply)
+	if err != nil {
+		return nil
+	}
+	b := append([]byte(nil), reply[:off]...)
+	b[2] |= 0x02 // TC
+	for i := 6; i < 12; i++ {
+		b[i] = 0
+	}
+	return b
+}
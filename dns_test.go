@@ -0,0 +1,257 @@
+package gost
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestUpstream starts a UDP name server which answers the A queries with 1.2.3.4.
+func dnsTestUpstream(t *testing.T, count *int32) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(count, 1)
+			pc.WriteTo(dnsTestReply(b[:n], net.IPv4(1, 2, 3, 4)), addr)
+		}
+	}()
+	return pc
+}
+
+func dnsTestQueryMessage(name string, typ dnsmessage.Type) []byte {
+	query, _ := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: typ, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	return query
+}
+
+func dnsTestQuery(t *testing.T, conn net.Conn, id uint16, name string, typ dnsmessage.Type) (dnsmessage.Header, []dnsmessage.Resource) {
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: typ, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	var reply []byte
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1500)
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply = b[:n]
+	} else {
+		if err := writeDNSMessage(conn, query); err != nil {
+			t.Fatal(err)
+		}
+		if reply, err = readDNSMessage(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != id || !m.Response {
+		t.Fatalf("invalid reply %+v", m.Header)
+	}
+	return m.Header, m.Answers
+}
+
+func TestDNSServer(t *testing.T) {
+	var count int32
+	upstream := dnsTestUpstream(t, &count)
+	defer upstream.Close()
+
+	ln, err := DNSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h := DNSHandler(
+		ResolverHandlerOption(NewResolver(3*time.Second, 0, NameServer{Addr: upstream.LocalAddr().String()})),
+		HostsHandlerOption(NewHosts(Host{IP: net.ParseIP("10.0.0.1"), Hostname: "local.example.com"})),
+	)
+	go (&Server{Listener: ln}).Serve(h)
+
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, answers := dnsTestQuery(t, conn, 1, "www.example.com.", dnsmessage.TypeA)
+		if len(answers) != 1 || answers[0].(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+			t.Errorf("%s: wrong answers %v", network, answers)
+		}
+		_, answers = dnsTestQuery(t, conn, 2, "local.example.com.", dnsmessage.TypeA)
+		if len(answers) != 1 || answers[0].(*dnsmessage.AResource).A != [4]byte{10, 0, 0, 1} {
+			t.Errorf("%s: wrong answers from hosts %v", network, answers)
+		}
+		_, answers = dnsTestQuery(t, conn, 3, "local.example.com.", dnsmessage.TypeAAAA)
+		if len(answers) != 0 {
+			t.Errorf("%s: AAAA should have no answer, got %v", network, answers)
+		}
+		conn.Close()
+	}
+
+	// the second query of www.example.com is answered from the cache.
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("upstream should be queried once, got %d", n)
+	}
+}
+
+func TestDNSMessageTTL(t *testing.T) {
+	query := dnsTestQueryMessage("example.com.", dnsmessage.TypeA)
+	reply := dnsTestReply(query, net.IPv4(1, 2, 3, 4))
+
+	if ttl, ok := dnsCacheTTL(reply); !ok || ttl != 60 {
+		t.Errorf("ttl should be 60, got %d", ttl)
+	}
+	dnsDecreaseTTL(reply, 15)
+	if ttl, _ := dnsCacheTTL(reply); ttl != 45 {
+		t.Errorf("ttl should be 45, got %d", ttl)
+	}
+	dnsDecreaseTTL(reply, 100)
+	if ttl, _ := dnsCacheTTL(reply); ttl != 0 {
+		t.Errorf("ttl should be 0, got %d", ttl)
+	}
+
+	// the negative reply is cached for the SOA MINIMUM, or not cached without SOA.
+	nx := dnsTestZoneReply(query)
+	if ttl, ok := dnsCacheTTL(nx); !ok || ttl != 5 {
+		t.Errorf("negative ttl should be 5, got %d", ttl)
+	}
+	if _, ok := dnsCacheTTL(dnsReply(dnsmessage.Header{ID: 1}, nil, dnsmessage.RCodeNameError)); ok {
+		t.Error("negative reply without SOA should not be cached")
+	}
+	if _, ok := dnsCacheTTL(dnsReply(dnsmessage.Header{ID: 1}, nil, dnsmessage.RCodeServerFailure)); ok {
+		t.Error("failed reply should not be cached")
+	}
+
+	tc := dnsTruncate(reply)
+	if len(tc) != len(query) || tc[2]&0x02 == 0 || tc[7] != 0 {
+		t.Errorf("wrong truncated message %v", tc)
+	}
+	if size := dnsUDPSize(query); size != dnsMinUDPSize {
+		t.Errorf("udp size should be %d, got %d", dnsMinUDPSize, size)
+	}
+}
+
+func TestDNSServerUpstreamID(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ids := make(chan uint16, 8)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			ids <- uint16(b[0])<<8 | uint16(b[1])
+			// the spoofed reply of the same ID for another question is ignored.
+			spoofed := dnsTestQueryMessage("evil.example.com.", dnsmessage.TypeA)
+			spoofed[0], spoofed[1] = b[0], b[1]
+			pc.WriteTo(dnsTestReply(spoofed, net.IPv4(6, 6, 6, 6)), addr)
+			pc.WriteTo(dnsTestReply(b[:n], net.IPv4(1, 2, 3, 4)), addr)
+		}
+	}()
+
+	ln, err := DNSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h := DNSHandler(ResolverHandlerOption(NewResolver(3*time.Second, -1, NameServer{Addr: pc.LocalAddr().String()})))
+	go (&Server{Listener: ln}).Serve(h)
+
+	conn, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	random := false
+	for i := 0; i < 3; i++ {
+		_, answers := dnsTestQuery(t, conn, 0x1234, "www.example.com.", dnsmessage.TypeA)
+		if len(answers) != 1 || answers[0].(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+			t.Errorf("wrong answers %v", answers)
+		}
+		if id := <-ids; id != 0x1234 {
+			random = true
+		}
+	}
+	if !random {
+		t.Error("the ID of the client should not be sent to the upstream")
+	}
+}
+
+func TestDNSServerPermissions(t *testing.T) {
+	hosts := NewHosts(
+		Host{IP: net.ParseIP("10.0.0.1"), Hostname: "local.example.com"},
+		Host{IP: net.ParseIP("10.0.0.2"), Hostname: "local.example.org"},
+	)
+	var listeners []Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	dial := func(whitelist string) net.Conn {
+		ln, err := DNSListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+		perms, _ := ParsePermissions(whitelist)
+		go (&Server{Listener: ln}).Serve(DNSHandler(HostsHandlerOption(hosts), WhitelistHandlerOption(perms)))
+
+		conn, err := net.Dial("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial("udp:*.example.com:53")
+	defer conn.Close()
+	if hdr, answers := dnsTestQuery(t, conn, 1, "local.example.com.", dnsmessage.TypeA); hdr.RCode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Errorf("got %v %v, want the answer", hdr.RCode, answers)
+	}
+	if hdr, answers := dnsTestQuery(t, conn, 2, "local.example.org.", dnsmessage.TypeA); hdr.RCode != dnsmessage.RCodeRefused || len(answers) != 0 {
+		t.Errorf("got %v %v, want refused", hdr.RCode, answers)
+	}
+
+	// the source of the client is checked too
+	conn = dial("udp:*:*:10.0.0.0/8")
+	defer conn.Close()
+	if hdr, _ := dnsTestQuery(t, conn, 3, "local.example.com.", dnsmessage.TypeA); hdr.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got %v, want refused", hdr.RCode)
+	}
+}
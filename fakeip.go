@@ -0,0 +1,277 @@
+package gost
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+const (
+	// fakeIPTTL is the TTL of the fake IP answers, the clients query again soon,
+	// so the mappings in use are kept as the recently used ones.
+	fakeIPTTL = 1
+)
+
+// FakeIP is a bounded table of the mappings between the domain names and the fake IPv4 addresses in a reserved pool,
+// such as 198.18.0.0/15. It is used for transparent proxying:
+// the DNS server answers the A queries with the fake addresses,
+// and the redirect handler maps the original destination back to the name to dial the chain by the hostname.
+// When the table is full, the least recently used mapping is dropped and its address is reused.
+type FakeIP struct {
+	pool  *net.IPNet
+	base  uint32 // the first address of the pool, the network address is skipped
+	count uint32 // the number of the addresses in the pool
+	size  int
+	next  uint32
+	ll    *list.List
+	names map[string]*list.Element
+	ips   map[uint32]*list.Element
+	dirty bool
+	mux   sync.Mutex
+}
+
+type fakeIPEntry struct {
+	name string
+	ip   uint32
+}
+
+// NewFakeIP creates a FakeIP table with the pool in CIDR notation,
+// the size is the max number of the mappings, it is the number of the addresses in the pool if it is zero.
+func NewFakeIP(cidr string, size int) (*FakeIP, error) {
+	_, pool, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := pool.IP.To4()
+	ones, bits := pool.Mask.Size()
+	if ip4 == nil || bits != 8*net.IPv4len {
+		return nil, errors.New("fakeip: the pool must be IPv4")
+	}
+	if bits-ones < 2 {
+		return nil, errors.New("fakeip: the pool is too small")
+	}
+
+	count := uint32(1)<<uint(bits-ones) - 2 // without the network and broadcast addresses
+	if size <= 0 || uint32(size) > count {
+		size = int(count)
+	}
+	return &FakeIP{
+		pool:  pool,
+		base:  fakeIPToUint32(ip4) + 1,
+		count: count,
+		size:  size,
+		ll:    list.New(),
+		names: make(map[string]*list.Element),
+		ips:   make(map[uint32]*list.Element),
+	}, nil
+}
+
+func fakeIPToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func fakeIPFromUint32(v uint32) net.IP {
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Contains reports whether the ip is in the pool.
+func (f *FakeIP) Contains(ip net.IP) bool {
+	if f == nil || ip == nil {
+		return false
+	}
+	return f.pool.Contains(ip)
+}
+
+// Lookup returns the fake address of the name, a new address is allocated if the name has none.
+func (f *FakeIP) Lookup(name string) net.IP {
+	if f == nil {
+		return nil
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if e := f.names[name]; e != nil {
+		f.ll.MoveToFront(e)
+		return fakeIPFromUint32(e.Value.(*fakeIPEntry).ip)
+	}
+
+	var ip uint32
+	if f.ll.Len() >= f.size {
+		// reuse the address of the least recently used mapping
+		e := f.ll.Back()
+		entry := e.Value.(*fakeIPEntry)
+		f.remove(e)
+		ip = entry.ip
+	} else {
+		for {
+			ip = f.base + f.next%f.count
+			f.next++
+			if f.ips[ip] == nil {
+				break
+			}
+		}
+	}
+	f.add(name, ip)
+	f.dirty = true
+	return fakeIPFromUint32(ip)
+}
+
+// Name returns the name mapped to the fake address.
+func (f *FakeIP) Name(ip net.IP) (string, bool) {
+	if !f.Contains(ip) {
+		return "", false
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	e := f.ips[fakeIPToUint32(ip4)]
+	if e == nil {
+		return "", false
+	}
+	f.ll.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).name, true
+}
+
+func (f *FakeIP) add(name string, ip uint32) {
+	e := f.ll.PushFront(&fakeIPEntry{name: name, ip: ip})
+	f.names[name] = e
+	f.ips[ip] = e
+}
+
+func (f *FakeIP) remove(e *list.Element) {
+	entry := e.Value.(*fakeIPEntry)
+	f.ll.Remove(e)
+	delete(f.names, entry.name)
+	delete(f.ips, entry.ip)
+}
+
+// Load loads the mappings in the format of 'ip name' per line, which is written by WriteTo,
+// the mappings out of the pool are ignored.
+func (f *FakeIP) Load(r io.Reader) error {
+	if f == nil {
+		return nil
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ss := strings.Fields(scanner.Text())
+		if len(ss) != 2 {
+			continue
+		}
+		ip := net.ParseIP(ss[0]).To4()
+		if ip == nil || !f.pool.Contains(ip) {
+			continue
+		}
+		v := fakeIPToUint32(ip)
+		if v < f.base || v >= f.base+f.count {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(ss[1], "."))
+		if e := f.names[name]; e != nil {
+			f.remove(e)
+		}
+		if e := f.ips[v]; e != nil {
+			f.remove(e)
+		}
+		f.add(name, v)
+		for f.ll.Len() > f.size {
+			f.remove(f.ll.Back())
+		}
+		if v-f.base >= f.next {
+			f.next = v - f.base + 1
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteTo writes the mappings in the format of 'ip name' per line, from the least recently used one.
+func (f *FakeIP) WriteTo(w io.Writer) (n int64, err error) {
+	if f == nil {
+		return
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for e := f.ll.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeIPEntry)
+		nn, err := fmt.Fprintf(bw, "%s %s\n", fakeIPFromUint32(entry.ip), entry.name)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// PeriodSave saves the mappings to the file periodically if they are changed.
+func (f *FakeIP) PeriodSave(file string, period time.Duration) error {
+	if f == nil {
+		return nil
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+
+	for {
+		<-time.After(period)
+
+		f.mux.Lock()
+		dirty := f.dirty
+		f.dirty = false
+		f.mux.Unlock()
+		if !dirty {
+			continue
+		}
+
+		if err := f.save(file); err != nil {
+			log.Log("[fakeip]", err)
+			f.mux.Lock()
+			f.dirty = true
+			f.mux.Unlock()
+		}
+	}
+}
+
+// save writes the mappings to a temporary file and renames it to the file.
+func (f *FakeIP) save(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := f.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
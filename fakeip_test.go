@@ -0,0 +1,105 @@
+package gost
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFakeIP(t *testing.T) {
+	if _, err := NewFakeIP("2001:db8::/64", 0); err == nil {
+		t.Error("IPv6 pool should not be supported")
+	}
+
+	f, err := NewFakeIP("198.18.0.0/30", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := f.Lookup("a.example.com.")
+	b := f.Lookup("B.example.com")
+	if !a.Equal(net.ParseIP("198.18.0.1")) || !b.Equal(net.ParseIP("198.18.0.2")) {
+		t.Fatalf("wrong addresses %s, %s", a, b)
+	}
+	if ip := f.Lookup("a.example.com"); !ip.Equal(a) {
+		t.Errorf("a.example.com should keep the address %s, got %s", a, ip)
+	}
+	if name, ok := f.Name(b); !ok || name != "b.example.com" {
+		t.Errorf("%s should be mapped to b.example.com, got %q", b, name)
+	}
+
+	// the table is full, the least recently used a.example.com is dropped.
+	c := f.Lookup("c.example.com")
+	if !c.Equal(a) {
+		t.Errorf("c.example.com should reuse the address %s, got %s", a, c)
+	}
+	if name, _ := f.Name(a); name != "c.example.com" {
+		t.Errorf("%s should be mapped to c.example.com, got %q", a, name)
+	}
+	if _, ok := f.Name(net.ParseIP("198.18.0.3")); ok {
+		t.Error("the broadcast address should not be mapped")
+	}
+	if f.Contains(net.ParseIP("198.19.0.1")) {
+		t.Error("198.19.0.1 should not be in the pool")
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := f.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	f2, _ := NewFakeIP("198.18.0.0/30", 0)
+	if err := f2.Load(bytes.NewReader(append(buf.Bytes(), "10.0.0.1 out.example.com\n"...))); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []net.IP{a, b} {
+		name1, _ := f.Name(ip)
+		name2, ok := f2.Name(ip)
+		if !ok || name1 != name2 {
+			t.Errorf("%s: the loaded mapping %q should be %q", ip, name2, name1)
+		}
+	}
+
+	if (*FakeIP)(nil).Lookup("a.example.com") != nil {
+		t.Error("nil table should have no address")
+	}
+}
+
+func TestDNSServerFakeIP(t *testing.T) {
+	f, err := NewFakeIP("198.18.0.0/15", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := DNSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&Server{Listener: ln}).Serve(DNSHandler(
+		FakeIPHandlerOption(f),
+		ResolverHandlerOption(NewResolver(time.Second, 0)), // no name server, the resolver should not be used
+	))
+
+	conn, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hdr, answers := dnsTestQuery(t, conn, 1, "www.example.com.", dnsmessage.TypeA)
+	if hdr.RCode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Fatalf("wrong reply %v %v", hdr, answers)
+	}
+	ip := net.IP(answers[0].(*dnsmessage.AResource).A[:])
+	if name, ok := f.Name(ip); !ok || name != "www.example.com" {
+		t.Errorf("%s should be mapped to www.example.com, got %q", ip, name)
+	}
+
+	hdr, answers = dnsTestQuery(t, conn, 2, "www.example.com.", dnsmessage.TypeAAAA)
+	if hdr.RCode != dnsmessage.RCodeSuccess || len(answers) != 0 {
+		t.Errorf("AAAA should have no answer, got %v %v", hdr, answers)
+	}
+}
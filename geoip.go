@@ -0,0 +1,398 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultGeoIP is the GeoIP database used by the geoip matchers created by NewMatcher,
+	// unless the matchers are bound to the database of the Bypass by SetGeoIP.
+	DefaultGeoIP *GeoIP
+)
+
+var (
+	mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+)
+
+// GeoIP is an offline GeoIP database in the MaxMind DB (mmdb) format, such as the GeoLite2 Country database.
+// The database is loaded by Reload, and it can be live reloaded by PeriodReload when the file changes.
+type GeoIP struct {
+	db     *mmdbReader
+	period time.Duration // the period for live reloading
+	mux    sync.RWMutex
+}
+
+// NewGeoIP creates an empty GeoIP database which is checked for reloading every period.
+func NewGeoIP(period time.Duration) *GeoIP {
+	return &GeoIP{
+		period: period,
+	}
+}
+
+// Country returns the ISO 3166-1 country code of the ip, it returns an empty string if it is not found.
+func (g *GeoIP) Country(ip net.IP) string {
+	if g == nil || ip == nil {
+		return ""
+	}
+
+	g.mux.RLock()
+	db := g.db
+	g.mux.RUnlock()
+
+	if db == nil {
+		return ""
+	}
+	v, err := db.lookup(ip)
+	if err != nil || v == nil {
+		return ""
+	}
+
+	record, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+// Reload parses the database from r, then live reloads the GeoIP.
+func (g *GeoIP) Reload(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	db, err := newMMDBReader(data)
+	if err != nil {
+		return err
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.db = db
+	return nil
+}
+
+// Period returns the reload period.
+func (g *GeoIP) Period() time.Duration {
+	return g.period
+}
+
+type geoipMatcher struct {
+	country string
+	db      *GeoIP
+}
+
+// GeoIPMatcher creates a Matcher for the IP addresses located in the country by the GeoIP database.
+// If db is nil, the DefaultGeoIP is used.
+func GeoIPMatcher(db *GeoIP, country string) Matcher {
+	return &geoipMatcher{
+		country: strings.ToUpper(country),
+		db:      db,
+	}
+}
+
+func (m *geoipMatcher) Match(ip string) bool {
+	if m == nil || m.country == "" {
+		return false
+	}
+	db := m.db
+	if db == nil {
+		db = DefaultGeoIP
+	}
+	return db.Country(net.ParseIP(ip)) == m.country
+}
+
+func (m *geoipMatcher) String() string {
+	return "geoip " + m.country
+}
+
+// mmdbReader is a minimal reader of the MaxMind DB format,
+// see https://maxmind.github.io/MaxMind-DB/ for the specification.
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func newMMDBReader(b []byte) (*mmdbReader, error) {
+	n := bytes.LastIndex(b, mmdbMetadataMarker)
+	if n < 0 {
+		return nil, errors.New("mmdb: invalid database, metadata not found")
+	}
+	meta := b[n+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbDecoder{buf: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: invalid metadata: %v", err)
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+
+	r := &mmdbReader{}
+	for key, p := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		v, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("mmdb: invalid metadata %s", key)
+		}
+		*p = uint(v)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(n) {
+		return nil, errors.New("mmdb: invalid database, tree is too large")
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+16 : n]
+
+	if r.ipVersion == 6 {
+		// the IPv4 addresses are in the ::/96 subnet of the IPv6 tree
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the data record of the ip, or nil if it is not found.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil // not found
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("mmdb: invalid data pointer")
+	}
+	v, _, err := (&mmdbDecoder{buf: r.data}).decode(offset, 0)
+	return v, err
+}
+
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode decodes the value at offset, it returns the value and the offset of the next value.
+// The maps are decoded as map[string]interface{}, the arrays as []interface{},
+// and all the unsigned integers as uint64.
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data is too deep")
+	}
+
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ss := uint(ctrl>>3) & 0x3
+		b, err := d.bytes(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 1:
+			p = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, offset + ss + 1, err
+	}
+	if typ == 0 { // extended type
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid map key")
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEnd:
+		return nil, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid integer size")
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
@@ -0,0 +1,259 @@
+package gost
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"testing"
+)
+
+// mmdbTestEncode encodes the value in the MaxMind DB data format,
+// only the strings, uint32 and maps are supported.
+func mmdbTestEncode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteByte(byte(mmdbString<<5 | len(v)))
+		buf.WriteString(v)
+	case uint32:
+		buf.WriteByte(byte(mmdbUint32<<5 | 4))
+		buf.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case map[string]interface{}:
+		buf.WriteByte(byte(mmdbMap<<5 | len(v)))
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbTestEncode(buf, k)
+			mmdbTestEncode(buf, v[k])
+		}
+	}
+}
+
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	data     int // the offset of the data record for the leaf, or -1.
+	id       int
+}
+
+// mmdbTestDB builds an IPv6 database with 24 bits records for the networks mapped to the data records.
+func mmdbTestDB(networks map[string]map[string]interface{}) []byte {
+	data := &bytes.Buffer{}
+	root := &mmdbTestNode{data: -1}
+	for cidr, record := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if bits == 8*net.IPv4len {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...) // ::a.b.c.d
+			ones += 96
+		}
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{data: -1}
+			}
+			node = node.children[bit]
+		}
+		node.data = data.Len()
+		mmdbTestEncode(data, record)
+	}
+
+	var nodes []*mmdbTestNode
+	queue := []*mmdbTestNode{root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node.data >= 0 {
+			continue
+		}
+		node.id = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, node := range nodes {
+		for _, child := range node.children {
+			v := len(nodes) // empty
+			if child != nil && child.data >= 0 {
+				v = len(nodes) + 16 + child.data
+			} else if child != nil {
+				v = child.id
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.Write(mmdbMetadataMarker)
+	mmdbTestEncode(buf, map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(6),
+		"database_type": "GeoLite2-Country",
+	})
+	return buf.Bytes()
+}
+
+func newTestGeoIP(t *testing.T) *GeoIP {
+	country := func(key, code string) map[string]interface{} {
+		return map[string]interface{}{
+			key: map[string]interface{}{"iso_code": code},
+		}
+	}
+	db := NewGeoIP(0)
+	err := db.Reload(bytes.NewReader(mmdbTestDB(map[string]map[string]interface{}{
+		"1.0.0.0/8":     country("country", "CN"),
+		"8.8.8.0/24":    country("country", "US"),
+		"2001:db8::/32": country("registered_country", "jp"),
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	db := newTestGeoIP(t)
+
+	var tests = []struct {
+		ip      string
+		country string
+	}{
+		{"1.2.3.4", "CN"},
+		{"::ffff:1.2.3.4", "CN"},
+		{"8.8.8.8", "US"},
+		{"8.8.9.9", ""},
+		{"2001:db8::1", "JP"},
+		{"2002::1", ""},
+	}
+	for _, test := range tests {
+		if country := db.Country(net.ParseIP(test.ip)); country != test.country {
+			t.Errorf("%s: country should be %q, got %q", test.ip, test.country, country)
+		}
+	}
+
+	if err := db.Reload(bytes.NewReader([]byte("invalid"))); err == nil {
+		t.Error("should return error for invalid database")
+	}
+	if db.Country(net.ParseIP("1.2.3.4")) != "CN" {
+		t.Error("the database should be kept on error")
+	}
+	if (*GeoIP)(nil).Country(net.ParseIP("1.2.3.4")) != "" {
+		t.Error("nil database should match nothing")
+	}
+}
+
+// testdata/GeoIP2-Country-Test.mmdb is a GeoIP2 Country database written by the MaxMind DB writer
+// (github.com/maxmind/mmdbwriter) with 28 bits records, the IPv4 aliases and the deduplicated (pointer) data,
+// the expected countries are the ones found by the MaxMind DB reader (github.com/oschwald/maxminddb-golang).
+var geoipDatabaseTests = []struct {
+	ip      string
+	country string
+}{
+	{"1.0.1.1", "CN"},
+	{"1.0.2.1", ""},
+	{"2.125.160.216", "GB"},
+	{"2.125.160.223", "GB"},
+	{"2.125.160.224", ""},
+	{"81.2.69.142", "GB"},
+	{"89.160.20.112", "SE"},
+	{"89.160.20.128", ""},
+	{"50.114.255.1", "US"},
+	{"67.43.156.1", "US"}, // the registered country only
+	{"::ffff:1.0.1.1", "CN"},
+	{"2002:100:100::", "CN"}, // the 6to4 alias of 1.0.1.0
+	{"2001:218:1::1", "CN"},
+	{"2001:219::1", ""},
+	{"2a02:ff87::1", "SE"},
+	{"2a02:ff88::1", ""},
+	{"::1", ""},
+	{"127.0.0.1", ""},
+	{"10.0.0.1", ""},
+}
+
+func TestGeoIPDatabase(t *testing.T) {
+	f, err := os.Open("testdata/GeoIP2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	db := NewGeoIP(0)
+	if err := db.Reload(f); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range geoipDatabaseTests {
+		if country := db.Country(net.ParseIP(test.ip)); country != test.country {
+			t.Errorf("%s: country should be %q, got %q", test.ip, test.country, country)
+		}
+	}
+}
+
+func TestBypassGeoIP(t *testing.T) {
+	db := newTestGeoIP(t)
+	if m := NewMatcher("geoip:cn"); m.String() != "geoip CN" {
+		t.Errorf("wrong matcher %s", m)
+	}
+
+	bp := NewBypass(false, GeoIPMatcher(db, "cn"), NewMatcher("*.example.org"))
+	lookup := func(ip string) func(host string) []net.IP {
+		return func(host string) []net.IP {
+			return []net.IP{net.ParseIP(ip)}
+		}
+	}
+
+	var tests = []struct {
+		addr     string
+		lookup   func(host string) []net.IP
+		bypassed bool
+	}{
+		{"1.1.1.1:443", nil, true},
+		{"8.8.8.8:443", nil, false},
+		{"example.cn:443", nil, false},
+		{"example.cn:443", lookup("1.1.1.1"), true},
+		{"example.com:443", lookup("8.8.8.8"), false},
+		{"www.example.org", lookup("8.8.8.8"), true},
+	}
+	for _, test := range tests {
+		if bp.ContainsLookup(test.addr, test.lookup) != test.bypassed {
+			t.Errorf("%s: bypassed should be %v", test.addr, test.bypassed)
+		}
+	}
+}
+
+func TestBypassSetGeoIP(t *testing.T) {
+	db := newTestGeoIP(t)
+
+	bp := NewBypass(false, NewMatcher("geoip:cn"))
+	if bp.Contains("1.1.1.1") {
+		t.Error("the geoip rule without database should match nothing")
+	}
+	bp.SetGeoIP(db)
+	if !bp.Contains("1.1.1.1") || bp.Contains("8.8.8.8") {
+		t.Error("the geoip rule should be bound to the database")
+	}
+
+	// the reloaded rules are bound to the database too
+	if err := bp.Reload(bytes.NewBufferString("geoip:us\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !bp.Contains("8.8.8.8") || bp.Contains("1.1.1.1") {
+		t.Error("the reloaded geoip rule should be bound to the database")
+	}
+	if NewBypassPatterns(false, "geoip:us").Contains("8.8.8.8") {
+		t.Error("the database of the bypass should not be shared")
+	}
+}
@@ -0,0 +1,217 @@
+package gost
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// AuthGuard tracks the authentication failures by source IP and by user name,
+// and bans the source IP which has too many failures in a time window.
+// The IPv6 sources are tracked by the /64 networks, as a client usually has a whole /64 network.
+// If a user name has more than MaxUserFailures failures from all the sources in the window,
+// such as a password guessing attack from many addresses, each failure of the user bans the source IP at once.
+// The user itself is never banned, so the clients can not lock out a user from the other addresses.
+// The ban time doubles for each subsequent ban, until the MaxBanTime is reached.
+// The clients from the Allowlist networks are never tracked.
+type AuthGuard struct {
+	MaxFailures     int           // the failures allowed in the Window, the guard is disabled if it is not positive.
+	MaxUserFailures int           // the failures of a user name allowed in the Window, they are not tracked if it is not positive.
+	Window          time.Duration // the time window of counting the failures.
+	BanTime         time.Duration // the initial ban time.
+	MaxBanTime      time.Duration // the max ban time, the default is 24 hours.
+	Allowlist       []*net.IPNet
+	records         map[string]*authRecord // indexed by the source IP or the /64 network
+	users           map[string]*authRecord // indexed by the user name
+	lastSweep       time.Time
+	mux             sync.Mutex
+}
+
+type authRecord struct {
+	failures int
+	start    time.Time // the start of the current window.
+	bans     int       // the number of the bans, used for the ban time growth.
+	until    time.Time // the end of the current ban.
+	last     time.Time // the time of the last failure.
+}
+
+// NewAuthGuard creates an AuthGuard which bans the source IP
+// for banTime after maxFailures authentication failures in the window.
+func NewAuthGuard(maxFailures int, window, banTime time.Duration) *AuthGuard {
+	return &AuthGuard{
+		MaxFailures: maxFailures,
+		Window:      window,
+		BanTime:     banTime,
+	}
+}
+
+// authGuardKey returns the key of the source IP, the IPv6 addresses are tracked by the /64 networks.
+func authGuardKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+func (g *AuthGuard) enabled(ip net.IP) bool {
+	if g == nil || g.MaxFailures <= 0 || ip == nil {
+		return false
+	}
+	return !networksContain(g.Allowlist, ip)
+}
+
+// Banned reports whether the source IP is banned.
+func (g *AuthGuard) Banned(ip net.IP) bool {
+	if !g.enabled(ip) {
+		return false
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	r := g.records[authGuardKey(ip)]
+	return r != nil && time.Now().Before(r.until)
+}
+
+// Fail records an authentication failure of the user from the source IP, the user can be empty if it is unknown.
+func (g *AuthGuard) Fail(ip net.IP, user string) {
+	if !g.enabled(ip) {
+		return
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := time.Now()
+	if g.records == nil {
+		g.records = make(map[string]*authRecord)
+	}
+	g.sweep(now)
+
+	key := authGuardKey(ip)
+	r := g.records[key]
+	if r == nil {
+		r = &authRecord{}
+		g.records[key] = r
+	}
+	if now.Before(r.until) {
+		return // already banned
+	}
+	if now.Sub(r.start) > g.Window {
+		r.failures = 0
+		r.start = now
+	}
+	r.failures++
+	r.last = now
+	userFailed := g.failUser(user, now)
+	if r.failures < g.MaxFailures && !userFailed {
+		return
+	}
+
+	d := g.maxBanTime()
+	if r.bans < 32 {
+		if t := g.BanTime << uint(r.bans); t > 0 && t < d {
+			d = t
+		}
+	}
+	r.bans++
+	r.failures = 0
+	r.until = now.Add(d)
+	log.Logf("[auth] ban %s for %s, banned: %v", key, d, g.bans(now))
+}
+
+// failUser records a failure of the user, it reports whether the user has too many failures in the window.
+func (g *AuthGuard) failUser(user string, now time.Time) bool {
+	if user == "" || g.MaxUserFailures <= 0 {
+		return false
+	}
+	if g.users == nil {
+		g.users = make(map[string]*authRecord)
+	}
+	r := g.users[user]
+	if r == nil {
+		r = &authRecord{}
+		g.users[user] = r
+	}
+	if now.Sub(r.start) > g.Window {
+		r.failures = 0
+		r.start = now
+	}
+	r.failures++
+	r.last = now
+	if r.failures > g.MaxUserFailures {
+		log.Logf("[auth] user %s has %d failures in %s", user, r.failures, g.Window)
+		return true
+	}
+	return false
+}
+
+// Succeed resets the failures of the source IP, the ban history and the failures of the user are kept.
+func (g *AuthGuard) Succeed(ip net.IP) {
+	if !g.enabled(ip) {
+		return
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if r := g.records[authGuardKey(ip)]; r != nil {
+		r.failures = 0
+	}
+}
+
+// Bans returns the banned source IPs with the remaining ban time.
+func (g *AuthGuard) Bans() []string {
+	if g == nil {
+		return nil
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return g.bans(time.Now())
+}
+
+func (g *AuthGuard) bans(now time.Time) (bans []string) {
+	for key, r := range g.records {
+		if now.Before(r.until) {
+			bans = append(bans, fmt.Sprintf("%s(%s)", key, r.until.Sub(now)/time.Second*time.Second))
+		}
+	}
+	sort.Strings(bans)
+	return
+}
+
+func (g *AuthGuard) maxBanTime() time.Duration {
+	if g.MaxBanTime > 0 {
+		return g.MaxBanTime
+	}
+	return 24 * time.Hour
+}
+
+// sweep removes the records which are not banned and have no failures in the window,
+// the records which have been banned are kept for the max ban time, so the ban time keeps growing.
+func (g *AuthGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.Window {
+		return
+	}
+	g.lastSweep = now
+
+	for key, r := range g.records {
+		if now.Before(r.until) {
+			continue
+		}
+		if (r.bans == 0 && now.Sub(r.last) > g.Window) || now.Sub(r.last) > g.maxBanTime() {
+			delete(g.records, key)
+		}
+	}
+	for user, r := range g.users {
+		if now.Sub(r.last) > g.Window {
+			delete(g.users, user)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package gost
 import (
 	"bufio"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/url"
 	"time"
@@ -20,23 +21,112 @@ type Handler interface {
 
 // HandlerOptions describes the options for Handler.
 type HandlerOptions struct {
-	Addr      string
-	Chain     *Chain
-	Users     []*url.Userinfo
-	TLSConfig *tls.Config
-	Whitelist *Permissions
-	Blacklist *Permissions
-	Strategy  Strategy
-	Bypass    *Bypass
-	Retries   int
-	Timeout   time.Duration
-	Resolver  Resolver
-	Hosts     *Hosts
+	Addr           string
+	Chain          *Chain
+	Users          []*url.Userinfo
+	Authenticator  Authenticator
+	AuthorizedKeys map[string]string
+	AuthGuard      *AuthGuard
+	TLSConfig      *tls.Config
+	Whitelist      *Permissions
+	Blacklist      *Permissions
+	Strategy       Strategy
+	Bypass         *Bypass
+	Retries        int
+	Timeout        time.Duration
+	IdleTimeout    time.Duration
+	Resolver       Resolver
+	Hosts          *Hosts
+	FakeIP         *FakeIP
+	ReverseProxy   *ReverseProxy
+	usersAuth      bool // the Authenticator is created from the Users
+	authResolved   bool // the Authenticator is resolved after the Users and Authenticator options are applied
+}
+
+// resolveAuthenticator creates the Authenticator from the Users if the Authenticator option is not set,
+// it is called by the handlers after all the options are applied, so it does not depend on the order of the options.
+func (opts *HandlerOptions) resolveAuthenticator() {
+	if opts.authResolved {
+		return
+	}
+	opts.authResolved = true
+	if opts.Authenticator == nil || opts.usersAuth {
+		opts.Authenticator = UsersAuthenticator(opts.Users...)
+		opts.usersAuth = true
+	}
 }
 
 // HandlerOption allows a common way to set handler options.
 type HandlerOption func(opts *HandlerOptions)
 
+// can checks the permissions of the client from src for the action to addr.
+// The Whitelist and Blacklist are checked first,
+// then the permissions of the user provided by the Authenticator if any.
+// The host of addr is resolved by the Hosts and Resolver when it is checked against the IP rules.
+func (opts *HandlerOptions) can(action string, addr string, src net.Addr, user string) bool {
+	r := newPermissionRequest(action, addr)
+	if r == nil {
+		return false
+	}
+	r.src = addrIP(src)
+	r.lookup = func() []net.IP {
+		return opts.lookupIP(r.host)
+	}
+
+	if !canRequest(r, opts.Whitelist, opts.Blacklist) {
+		return false
+	}
+	if up, ok := opts.Authenticator.(UserPermissions); ok && user != "" {
+		if whitelist, blacklist, ok := up.UserPermissions(user); ok {
+			return canRequest(r, whitelist, blacklist)
+		}
+	}
+	return true
+}
+
+// bypass reports whether the Bypass includes addr,
+// the host of addr is resolved by the Hosts and Resolver when it is checked against the geoip rules.
+func (opts *HandlerOptions) bypass(addr string) bool {
+	return opts.Bypass.ContainsLookup(addr, opts.lookupIP)
+}
+
+func (opts *HandlerOptions) lookupIP(host string) []net.IP {
+	return lookupIP(host, opts.Hosts, opts.Resolver)
+}
+
+// lookupIP resolves the host by the hosts and resolver,
+// the addresses from the hosts are ordered by the address family preference of the resolver.
+func lookupIP(host string, hosts *Hosts, resolver Resolver) []net.IP {
+	if ips := hosts.lookupIPs(host, resolverPrefer(resolver)); len(ips) > 0 {
+		return ips
+	}
+	if resolver != nil {
+		ips, err := resolver.Resolve(host)
+		if err != nil {
+			log.Logf("[resolver] %s: %v", host, err)
+		}
+		return ips
+	}
+	return nil
+}
+
+// addrIP returns the IP address of addr, it returns nil if addr has no IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 // AddrHandlerOption sets the Addr option of HandlerOptions.
 func AddrHandlerOption(addr string) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -52,9 +142,36 @@ func ChainHandlerOption(chain *Chain) HandlerOption {
 }
 
 // UsersHandlerOption sets the Users option of HandlerOptions.
+// If the Authenticator option is not set, the users will be used for authentication.
 func UsersHandlerOption(users ...*url.Userinfo) HandlerOption {
 	return func(opts *HandlerOptions) {
 		opts.Users = users
+		opts.authResolved = false
+	}
+}
+
+// AuthorizedKeysHandlerOption sets the AuthorizedKeys option of HandlerOptions,
+// it is used by the SSH server for public key authentication.
+// The keys are indexed by the marshaled key, and the value is the user of the key.
+func AuthorizedKeysHandlerOption(keys map[string]string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.AuthorizedKeys = keys
+	}
+}
+
+// AuthGuardHandlerOption sets the AuthGuard option of HandlerOptions.
+func AuthGuardHandlerOption(g *AuthGuard) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.AuthGuard = g
+	}
+}
+
+// AuthenticatorHandlerOption sets the Authenticator option of HandlerOptions.
+func AuthenticatorHandlerOption(au Authenticator) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Authenticator = au
+		opts.usersAuth = false
+		opts.authResolved = false
 	}
 }
 
@@ -107,6 +224,14 @@ func TimeoutHandlerOption(timeout time.Duration) HandlerOption {
 	}
 }
 
+// IdleTimeoutHandlerOption sets the idle timeout option of HandlerOptions,
+// it is the max time to wait for the next request of a keep-alive connection.
+func IdleTimeoutHandlerOption(timeout time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.IdleTimeout = timeout
+	}
+}
+
 // ResolverHandlerOption sets the resolver option of HandlerOptions.
 func ResolverHandlerOption(resolver Resolver) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -121,6 +246,20 @@ func HostsHandlerOption(hosts *Hosts) HandlerOption {
 	}
 }
 
+// FakeIPHandlerOption sets the FakeIP option of HandlerOptions.
+func FakeIPHandlerOption(f *FakeIP) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.FakeIP = f
+	}
+}
+
+// ReverseProxyHandlerOption sets the ReverseProxy option of HandlerOptions.
+func ReverseProxyHandlerOption(p *ReverseProxy) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ReverseProxy = p
+	}
+}
+
 type autoHandler struct {
 	options *HandlerOptions
 }
@@ -139,6 +278,7 @@ func (h *autoHandler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
 }
 
 func (h *autoHandler) Handle(conn net.Conn) {
@@ -155,8 +295,9 @@ func (h *autoHandler) Handle(conn net.Conn) {
 	switch b[0] {
 	case gosocks4.Ver4:
 		// SOCKS4(a) does not suppport authentication method,
-		// so we ignore it when credentials are specified for security reason.
-		if len(h.options.Users) > 0 {
+		// so we ignore it when credentials are specified for security reason,
+		// unless the client has been authenticated by the TLS client certificate.
+		if h.options.Authenticator != nil && tlsClientUser(conn) == "" {
 			cc.Close()
 			return
 		}
@@ -178,3 +319,15 @@ type bufferdConn struct {
 func (c *bufferdConn) Read(b []byte) (int, error) {
 	return c.br.Read(b)
 }
+
+// flush writes the buffered but unread data to w.
+func (c *bufferdConn) flush(w io.Writer) (int64, error) {
+	n := c.br.Buffered()
+	if n == 0 {
+		return 0, nil
+	}
+	b, _ := c.br.Peek(n)
+	nw, err := w.Write(b)
+	c.br.Discard(nw)
+	return int64(nw), err
+}
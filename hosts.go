@@ -5,12 +5,15 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-log/log"
 )
 
 // Host is a static mapping from hostname to IP.
+// The hostname and aliases can be a wildcard in the form of *.domain, which matches all the subdomains of the domain.
 type Host struct {
 	IP       net.IP
 	Hostname string
@@ -22,42 +25,136 @@ type Host struct {
 // IP_address canonical_hostname [aliases...]
 // Fields of the entry are separated by any number of blanks and/or tab characters.
 // Text from a "#" character until the end of the line is a comment, and is ignored.
+// A hostname can be present in several lines for multiple IP addresses, such as an IPv4 and an IPv6 address.
 type Hosts struct {
-	hosts  []Host
-	period time.Duration
+	hosts     []Host
+	names     map[string][]net.IP // the addresses of the hostnames
+	wildcards map[string][]net.IP // the addresses of the domains of the wildcards
+	rotation  uint32
+	period    time.Duration
+	mux       sync.RWMutex
 }
 
 // NewHosts creates a Hosts with optional list of host
 func NewHosts(hosts ...Host) *Hosts {
-	return &Hosts{
-		hosts: hosts,
-	}
+	h := &Hosts{}
+	h.setHosts(hosts)
+	return h
 }
 
 // AddHost adds host(s) to the host table.
 func (h *Hosts) AddHost(host ...Host) {
-	h.hosts = append(h.hosts, host...)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.setHosts(append(h.hosts[:len(h.hosts):len(h.hosts)], host...))
+}
+
+// setHosts builds the lookup tables of the hosts, and replaces the current ones.
+// The caller must hold the write lock if h is in use.
+func (h *Hosts) setHosts(hosts []Host) {
+	names := make(map[string][]net.IP)
+	wildcards := make(map[string][]net.IP)
+	for _, host := range hosts {
+		if host.IP == nil {
+			continue
+		}
+		for _, name := range append([]string{host.Hostname}, host.Aliases...) {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			m := names
+			if strings.HasPrefix(name, "*.") {
+				name = name[2:]
+				m = wildcards
+			}
+			if name == "" || containsIP(m[name], host.IP) {
+				continue
+			}
+			m[name] = append(m[name], host.IP)
+		}
+	}
+
+	h.hosts = hosts
+	h.names = names
+	h.wildcards = wildcards
 }
 
-// Lookup searches the IP address corresponds to the given host from the host table.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup searches the IP address corresponds to the given host from the host table,
+// it is the first one of the addresses returned by LookupIPs.
 func (h *Hosts) Lookup(host string) (ip net.IP) {
+	if ips := h.LookupIPs(host); len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+// LookupIPs searches the IP addresses correspond to the given host from the host table.
+// The exact hostname is matched first, then the wildcards from the longest domain.
+// The IPv4 addresses are in front of the IPv6 addresses, and the order of each address family is rotated for each lookup.
+func (h *Hosts) LookupIPs(host string) (ips []net.IP) {
+	return h.lookupIPs(host, "")
+}
+
+// lookupIPs is like LookupIPs, but the addresses are filtered and ordered by the address family preference
+// of the resolver, such as ResolverPreferIPv6, the IPv4 addresses come first if prefer is empty.
+func (h *Hosts) lookupIPs(host string, prefer string) (ips []net.IP) {
 	if h == nil {
 		return
 	}
-	for _, h := range h.hosts {
-		if h.Hostname == host {
-			ip = h.IP
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	h.mux.RLock()
+	found := h.names[name]
+	for len(found) == 0 {
+		n := strings.IndexByte(name, '.')
+		if n < 0 {
 			break
 		}
-		for _, alias := range h.Aliases {
-			if alias == host {
-				ip = h.IP
-				break
-			}
+		name = name[n+1:]
+		found = h.wildcards[name]
+	}
+	h.mux.RUnlock()
+
+	if len(found) == 0 {
+		return
+	}
+
+	var ip4s, ip6s []net.IP
+	for _, ip := range found {
+		if ip.To4() != nil {
+			ip4s = append(ip4s, ip)
+		} else {
+			ip6s = append(ip6s, ip)
+		}
+	}
+	families := [][]net.IP{ip4s, ip6s}
+	switch strings.ToLower(prefer) {
+	case ResolverIPv4Only:
+		families = [][]net.IP{ip4s}
+	case ResolverIPv6Only:
+		families = [][]net.IP{ip6s}
+	case ResolverPreferIPv6:
+		families = [][]net.IP{ip6s, ip4s}
+	}
+	n := atomic.AddUint32(&h.rotation, 1)
+	for _, v := range families {
+		if len(v) > 0 {
+			k := int(n % uint32(len(v)))
+			ips = append(ips, v[k:]...)
+			ips = append(ips, v[:k]...)
 		}
 	}
-	if ip != nil && Debug {
-		log.Logf("[hosts] hit: %s %s", host, ip.String())
+
+	if Debug {
+		log.Logf("[hosts] hit: %s %v", host, ips)
 	}
 	return
 }
@@ -65,6 +162,7 @@ func (h *Hosts) Lookup(host string) (ip net.IP) {
 // Reload parses config from r, then live reloads the hosts.
 func (h *Hosts) Reload(r io.Reader) error {
 	var hosts []Host
+	var period time.Duration
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -89,7 +187,7 @@ func (h *Hosts) Reload(r io.Reader) error {
 
 		// reload option
 		if strings.ToLower(ss[0]) == "reload" {
-			h.period, _ = time.ParseDuration(ss[1])
+			period, _ = time.ParseDuration(ss[1])
 			continue
 		}
 
@@ -110,11 +208,17 @@ func (h *Hosts) Reload(r io.Reader) error {
 		return err
 	}
 
-	h.hosts = hosts
+	h.mux.Lock()
+	h.setHosts(hosts)
+	h.period = period
+	h.mux.Unlock()
 	return nil
 }
 
 // Period returns the reload period
 func (h *Hosts) Period() time.Duration {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
 	return h.period
 }
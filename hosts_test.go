@@ -0,0 +1,129 @@
+package gost
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+var hostsTestData = `
+reload 10s
+10.0.0.1 example.com www.example.com
+10.0.0.2 example.com
+2001:db8::1 example.com
+10.0.1.1 *.example.com
+10.0.2.1 *.dev.example.com api.dev.example.com
+`
+
+func TestHostsLookup(t *testing.T) {
+	h := NewHosts()
+	if err := h.Reload(bytes.NewBufferString(hostsTestData)); err != nil {
+		t.Fatal(err)
+	}
+	if h.Period().Seconds() != 10 {
+		t.Errorf("period should be 10s, got %v", h.Period())
+	}
+
+	var tests = []struct {
+		host string
+		ips  string
+	}{
+		{"www.example.com", "[10.0.0.1]"},
+		{"WWW.Example.com.", "[10.0.0.1]"},
+		{"foo.example.com", "[10.0.1.1]"},
+		{"a.b.example.com", "[10.0.1.1]"},
+		{"api.dev.example.com", "[10.0.2.1]"},
+		{"x.dev.example.com", "[10.0.2.1]"},
+		{"dev.example.com", "[10.0.1.1]"},
+		{"example.org", "[]"},
+		{"com", "[]"},
+	}
+	for _, test := range tests {
+		if ips := fmt.Sprint(h.LookupIPs(test.host)); ips != test.ips {
+			t.Errorf("%s: got %s, want %s", test.host, ips, test.ips)
+		}
+	}
+
+	// the IPv4 addresses are rotated in front of the IPv6 address.
+	ips1 := h.LookupIPs("example.com")
+	ips2 := h.LookupIPs("example.com")
+	if len(ips1) != 3 || len(ips2) != 3 || !ips1[2].Equal(net.ParseIP("2001:db8::1")) || !ips2[2].Equal(ips1[2]) {
+		t.Fatalf("wrong addresses %v, %v", ips1, ips2)
+	}
+	if !ips1[0].Equal(ips2[1]) || !ips1[1].Equal(ips2[0]) {
+		t.Errorf("the IPv4 addresses should be rotated, got %v, %v", ips1, ips2)
+	}
+
+	h.AddHost(Host{IP: net.ParseIP("10.0.3.1"), Hostname: "new.example.org"})
+	if ip := h.Lookup("new.example.org"); !ip.Equal(net.ParseIP("10.0.3.1")) {
+		t.Errorf("added host should be found, got %v", ip)
+	}
+	if (*Hosts)(nil).Lookup("example.com") != nil {
+		t.Error("nil hosts should find nothing")
+	}
+}
+
+func TestHostsLookupPrefer(t *testing.T) {
+	h := NewHosts(
+		Host{IP: net.ParseIP("10.0.0.1"), Hostname: "example.com"},
+		Host{IP: net.ParseIP("2001:db8::1"), Hostname: "example.com"},
+	)
+
+	var tests = []struct {
+		prefer string
+		ips    string
+	}{
+		{"", "[10.0.0.1 2001:db8::1]"},
+		{ResolverPreferIPv4, "[10.0.0.1 2001:db8::1]"},
+		{ResolverPreferIPv6, "[2001:db8::1 10.0.0.1]"},
+		{ResolverIPv4Only, "[10.0.0.1]"},
+		{ResolverIPv6Only, "[2001:db8::1]"},
+	}
+	for _, test := range tests {
+		r := NewResolver(0, -1).(*resolver)
+		r.Prefer = test.prefer
+		if ips := fmt.Sprint(lookupIP("example.com", h, r)); ips != test.ips {
+			t.Errorf("%q: got %s, want %s", test.prefer, ips, test.ips)
+		}
+	}
+}
+
+func TestHostsReloadRace(t *testing.T) {
+	h := NewHosts()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.LookupIPs("www.example.com")
+				h.Period()
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		h.Reload(bytes.NewBufferString(hostsTestData))
+	}
+	wg.Wait()
+}
+
+func TestHostsAddHostConcurrent(t *testing.T) {
+	h := NewHosts()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.AddHost(Host{IP: net.IPv4(10, 0, byte(i), byte(j)), Hostname: "example.com"})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ips := h.LookupIPs("example.com"); len(ips) != 200 {
+		t.Errorf("got %d addresses, want 200", len(ips))
+	}
+}
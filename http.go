@@ -2,13 +2,16 @@ package gost
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-log/log"
@@ -70,7 +73,9 @@ func (c *httpConnector) Connect(conn net.Conn, addr string) (net.Conn, error) {
 }
 
 type httpHandler struct {
-	options *HandlerOptions
+	options  *HandlerOptions
+	connPool *httpConnPool
+	poolOnce sync.Once
 }
 
 // HTTPHandler creates a server Handler for HTTP proxy server.
@@ -87,30 +92,55 @@ func (h *httpHandler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
 }
 
+// Handle serves the requests of the connection in a loop, so the keep-alive clients can send
+// the requests to different hosts on the same connection, each request is authorized and routed individually.
+// The connection is taken over by the tunnel of the CONNECT or upgrade request.
+// The connection is closed if the header of the next request is not read in the IdleTimeout (ReadTimeout by default).
 func (h *httpHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	req, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		log.Logf("[http] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
-		return
+	idleTimeout := h.options.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = ReadTimeout
 	}
-	defer req.Body.Close()
 
-	h.handleRequest(conn, req)
+	br := bufio.NewReader(conn)
+	conn = &bufferdConn{br: br, Conn: conn}
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				log.Logf("[http] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if !h.handleRequest(conn, req) {
+			req.Body.Close()
+			return
+		}
+		req.Body.Close()
+	}
 }
 
-func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
+// handleRequest handles the request, it reports whether the connection can be used for the next request.
+func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) bool {
 	if req == nil {
-		return
+		return false
 	}
 	if Debug {
 		dump, _ := httputil.DumpRequest(req, false)
 		log.Logf("[http] %s -> %s\n%s", conn.RemoteAddr(), req.Host, string(dump))
 	}
 
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() && h.options.ReverseProxy != nil {
+		return h.reverseRequest(conn, req)
+	}
+
 	if req.Method == "PRI" || (req.Method != http.MethodConnect && req.URL.Scheme != "http") {
 		resp := "HTTP/1.1 400 Bad Request\r\n" +
 			"Proxy-Agent: gost/" + Version + "\r\n\r\n"
@@ -118,7 +148,7 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 		if Debug {
 			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), req.Host, resp)
 		}
-		return
+		return false
 	}
 
 	// try to get the actual host.
@@ -128,7 +158,38 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 		}
 	}
 
-	if !Can("tcp", req.Host, h.options.Whitelist, h.options.Blacklist) {
+	u, p, _ := basicProxyAuth(req.Header.Get("Proxy-Authorization"))
+	if Debug && (u != "" || p != "") {
+		log.Logf("[http] %s - %s : Authorization: '%s' '%s'", conn.RemoteAddr(), req.Host, u, p)
+	}
+	if user := tlsClientUser(conn); user != "" {
+		u = user // authenticated by the client certificate
+	} else if h.options.Authenticator != nil {
+		ip := addrIP(conn.RemoteAddr())
+		// the banned client is always rejected without checking the credentials.
+		banned := h.options.AuthGuard.Banned(ip)
+		id, ok := "", false
+		if !banned {
+			id, ok = authenticate(h.options.Authenticator, u, p)
+		}
+		if !ok {
+			if banned {
+				log.Logf("[http] %s - %s : banned", conn.RemoteAddr(), req.Host)
+			} else if u != "" || p != "" {
+				h.options.AuthGuard.Fail(ip, u)
+			}
+			log.Logf("[http] %s <- %s : proxy authentication required", conn.RemoteAddr(), req.Host)
+			resp := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+				"Proxy-Authenticate: Basic realm=\"gost\"\r\n" +
+				"Proxy-Agent: gost/" + Version + "\r\n\r\n"
+			conn.Write([]byte(resp))
+			return false
+		}
+		h.options.AuthGuard.Succeed(ip)
+		u = id
+	}
+
+	if !h.options.can("tcp", req.Host, conn.RemoteAddr(), u) {
 		log.Logf("[http] Unauthorized to tcp connect to %s", req.Host)
 		b := []byte("HTTP/1.1 403 Forbidden\r\n" +
 			"Proxy-Agent: gost/" + Version + "\r\n\r\n")
@@ -136,10 +197,10 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 		if Debug {
 			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), req.Host, string(b))
 		}
-		return
+		return false
 	}
 
-	if h.options.Bypass.Contains(req.Host) {
+	if h.options.bypass(req.Host) {
 		log.Logf("[http] [bypass] %s", req.Host)
 		b := []byte("HTTP/1.1 403 Forbidden\r\n" +
 			"Proxy-Agent: gost/" + Version + "\r\n\r\n")
@@ -147,64 +208,30 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 		if Debug {
 			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), req.Host, string(b))
 		}
-		return
-	}
-
-	u, p, _ := basicProxyAuth(req.Header.Get("Proxy-Authorization"))
-	if Debug && (u != "" || p != "") {
-		log.Logf("[http] %s - %s : Authorization: '%s' '%s'", conn.RemoteAddr(), req.Host, u, p)
-	}
-	if !authenticate(u, p, h.options.Users...) {
-		log.Logf("[http] %s <- %s : proxy authentication required", conn.RemoteAddr(), req.Host)
-		resp := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
-			"Proxy-Authenticate: Basic realm=\"gost\"\r\n" +
-			"Proxy-Agent: gost/" + Version + "\r\n\r\n"
-		conn.Write([]byte(resp))
-		return
+		return false
 	}
 
 	req.Header.Del("Proxy-Authorization")
-	// req.Header.Del("Proxy-Connection")
+
+	if req.Method != http.MethodConnect {
+		return h.proxyRequest(conn, req, u, nil)
+	}
 
 	host := req.Host
 	if _, port, _ := net.SplitHostPort(host); port == "" {
 		host = net.JoinHostPort(req.Host, "80")
 	}
 
-	retries := 1
-	if h.options.Chain != nil && h.options.Chain.Retries > 0 {
-		retries = h.options.Chain.Retries
-	}
-	if h.options.Retries > 0 {
-		retries = h.options.Retries
-	}
-
 	var err error
 	var cc net.Conn
-	var route *Chain
-	for i := 0; i < retries; i++ {
-		route, err = h.options.Chain.selectRouteFor(req.Host)
+	for i := 0; i < h.retries(); i++ {
+		var route *Chain
+		route, err = h.options.Chain.selectRouteFor(req.Host, h.options.lookupIP)
 		if err != nil {
 			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), req.Host, err)
 			continue
 		}
-		// forward http request
-		lastNode := route.LastNode()
-		if req.Method != http.MethodConnect && lastNode.Protocol == "http" {
-			err = h.forwardRequest(conn, req, route)
-			if err == nil {
-				return
-			}
-			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), req.Host, err)
-			continue
-		}
-
-		cc, err = route.Dial(host,
-			RetryChainOption(1),
-			TimeoutChainOption(h.options.Timeout),
-			HostsChainOption(h.options.Hosts),
-			ResolverChainOption(h.options.Resolver),
-		)
+		cc, err = h.dial(route, host)
 		if err == nil {
 			break
 		}
@@ -212,82 +239,392 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 
 	if err != nil {
 		log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), host, err)
+		h.serviceUnavailable(conn, host)
+		return false
+	}
+	defer cc.Close()
 
-		b := []byte("HTTP/1.1 503 Service unavailable\r\n" +
-			"Proxy-Agent: gost/" + Version + "\r\n\r\n")
+	b := []byte("HTTP/1.1 200 Connection established\r\n" +
+		"Proxy-Agent: gost/" + Version + "\r\n\r\n")
+	if Debug {
+		log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(b))
+	}
+	conn.Write(b)
+
+	var su string
+	if u != "" {
+		su = u + "@"
+	}
+
+	log.Logf("[http] %s%s <-> %s", su, cc.LocalAddr(), host)
+	transport(conn, cc)
+	log.Logf("[http] %s%s >-< %s", su, cc.LocalAddr(), host)
+	return false
+}
+
+func (h *httpHandler) retries() int {
+	retries := 1
+	if h.options.Chain != nil && h.options.Chain.Retries > 0 {
+		retries = h.options.Chain.Retries
+	}
+	if h.options.Retries > 0 {
+		retries = h.options.Retries
+	}
+	return retries
+}
+
+func (h *httpHandler) dial(route *Chain, host string) (net.Conn, error) {
+	return route.Dial(host,
+		RetryChainOption(1), // we control the retry manually.
+		TimeoutChainOption(h.options.Timeout),
+		HostsChainOption(h.options.Hosts),
+		ResolverChainOption(h.options.Resolver),
+	)
+}
+
+func (h *httpHandler) serviceUnavailable(conn net.Conn, host string) {
+	b := []byte("HTTP/1.1 503 Service unavailable\r\n" +
+		"Proxy-Agent: gost/" + Version + "\r\n" +
+		"Content-Length: 0\r\n\r\n")
+	if Debug {
+		log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(b))
+	}
+	conn.Write(b)
+}
+
+// reverseRequest sends the request in origin form to the backend of the matched ReverseProxy rule.
+// The request is not authenticated by the proxy authentication, and it is sent by proxyRequest
+// with the X-Forwarded-* headers, the Host header is the one of the backend.
+func (h *httpHandler) reverseRequest(conn net.Conn, req *http.Request) bool {
+	rule := h.options.ReverseProxy.Match(req.Host, req.URL.EscapedPath())
+	if rule == nil {
+		log.Logf("[http] %s - %s : no reverse proxy rule for %s%s", conn.RemoteAddr(), conn.LocalAddr(), req.Host, req.URL.Path)
+		b := []byte("HTTP/1.1 404 Not Found\r\n" +
+			"Content-Length: 0\r\n\r\n")
 		if Debug {
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(b))
+			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), req.Host, string(b))
 		}
 		conn.Write(b)
-		return
+		return !req.Close
 	}
-	defer cc.Close()
 
-	if req.Method == http.MethodConnect {
-		b := []byte("HTTP/1.1 200 Connection established\r\n" +
-			"Proxy-Agent: gost/" + Version + "\r\n\r\n")
+	u := rule.Backend
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "80")
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	if !h.options.can("tcp", addr, conn.RemoteAddr(), "") || h.options.bypass(addr) {
+		log.Logf("[http] %s - %s : forbidden to reverse proxy to %s", conn.RemoteAddr(), req.Host, addr)
+		b := []byte("HTTP/1.1 403 Forbidden\r\n" +
+			"Content-Length: 0\r\n\r\n")
 		if Debug {
-			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(b))
+			log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), req.Host, string(b))
 		}
 		conn.Write(b)
-	} else {
-		req.Header.Del("Proxy-Connection")
+		return false
+	}
 
-		if err = req.Write(cc); err != nil {
-			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), host, err)
-			return
+	// the X-Forwarded-For of the client is replaced, as it can not be trusted.
+	req.Header.Del("X-Forwarded-For")
+	if ip := addrIP(conn.RemoteAddr()); ip != nil {
+		req.Header.Set("X-Forwarded-For", ip.String())
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	proto := "http"
+	if tlsConnectionState(conn) != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Del("Proxy-Authorization")
+
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = req.URL.RawQuery
+	case req.URL.RawQuery != "":
+		u.RawQuery += "&" + req.URL.RawQuery
+	}
+	if Debug {
+		log.Logf("[http] %s - %s : reverse proxy %s%s to %s", conn.RemoteAddr(), conn.LocalAddr(), req.Host, req.URL, u)
+	}
+	req.URL = u
+	req.Host = u.Host
+
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		tlsConfig = &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: rule.Insecure,
 		}
 	}
+	return h.proxyRequest(conn, req, "", tlsConfig)
+}
+
+// proxyRequest forwards the request with the absolute URI to the target host, or to the upstream HTTP proxy
+// if it is the last node of the route, and writes the response back to the client.
+// The upstream connections are kept in a pool per route and target for the following requests.
+// The request is sent by the TLS connection with the tlsConfig if it is not nil.
+// It reports whether the client connection can be used for the next request.
+func (h *httpHandler) proxyRequest(conn net.Conn, req *http.Request, user string, tlsConfig *tls.Config) bool {
+	host := req.Host
+	if _, port, _ := net.SplitHostPort(host); port == "" {
+		if tlsConfig != nil {
+			host = net.JoinHostPort(req.Host, "443")
+		} else {
+			host = net.JoinHostPort(req.Host, "80")
+		}
+	}
+	req.Header.Del("Proxy-Connection")
+	if !req.URL.IsAbs() {
+		req.URL.Scheme = "http" // make sure that the URL is absolute
+	}
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+	}
+
+	// the upgraded connection, such as WebSocket, is tunneled without pooling.
+	upgrade := req.Header.Get("Upgrade") != ""
+
+	var err error
+	var pc *httpPoolConn
+	var resp *http.Response
+	for i := 0; i < h.retries(); i++ {
+		var route *Chain
+		route, err = h.options.Chain.selectRouteFor(req.Host, h.options.lookupIP)
+		if err != nil {
+			log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), req.Host, err)
+			continue
+		}
+		pc, resp, err = h.roundTrip(route, host, req, upgrade, tlsConfig)
+		if err == nil {
+			break
+		}
+		log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), host, err)
+		if req.Body != nil && req.Body != http.NoBody {
+			break // the body is consumed
+		}
+	}
+	if err != nil {
+		h.serviceUnavailable(conn, host)
+		return false
+	}
 
 	var su string
-	if u != "" {
-		su = u + "@"
+	if user != "" {
+		su = user + "@"
 	}
 
-	log.Logf("[http] %s%s <-> %s", su, cc.LocalAddr(), host)
-	transport(conn, cc)
-	log.Logf("[http] %s%s >-< %s", su, cc.LocalAddr(), host)
-}
+	if upgrade {
+		defer pc.Close()
+		log.Logf("[http] %s%s <-> %s", su, pc.LocalAddr(), host)
+		transport(conn, pc)
+		log.Logf("[http] %s%s >-< %s", su, pc.LocalAddr(), host)
+		return false
+	}
+
+	if Debug {
+		dump, _ := httputil.DumpResponse(resp, false)
+		log.Logf("[http] %s <- %s\n%s", conn.RemoteAddr(), host, string(dump))
+	}
+	log.Logf("[http] %s%s <-> %s : %s %s %d", su, pc.LocalAddr(), host, req.Method, req.URL, resp.StatusCode)
 
-func (h *httpHandler) forwardRequest(conn net.Conn, req *http.Request, route *Chain) error {
-	if route.IsEmpty() {
-		return nil
+	// the response without the length is delimited by closing the connection.
+	keepAlive := !req.Close && !resp.Close &&
+		(resp.ContentLength >= 0 || (len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"))
+	if !keepAlive {
+		resp.Close = true
 	}
+	err = resp.Write(conn)
+	resp.Body.Close()
+	if err != nil || resp.Close {
+		pc.Close()
+	} else {
+		h.pool().put(pc)
+	}
+	if err != nil {
+		log.Logf("[http] %s <- %s : %s", conn.RemoteAddr(), host, err)
+		return false
+	}
+	return keepAlive
+}
+
+// roundTrip sends the request to the host by an idle connection in the pool, or a new connection through the route,
+// the request is sent again by a new connection if the idle connection fails and the request has no body.
+// For the upgrade request, the response is not read, and the connection is not from the pool.
+// The request is sent by the TLS connection to the host through the route if the tlsConfig is not nil.
+func (h *httpHandler) roundTrip(route *Chain, host string, req *http.Request, upgrade bool, tlsConfig *tls.Config) (*httpPoolConn, *http.Response, error) {
 	lastNode := route.LastNode()
+	proxy := tlsConfig == nil && !route.IsEmpty() && lastNode.Protocol == "http"
 
-	cc, err := route.Conn(
-		RetryChainOption(1), // we control the retry manually.
-	)
+	// the connections to the upstream HTTP proxy are shared by all the targets.
+	var addrs []string
+	if !route.IsEmpty() {
+		for _, node := range route.Nodes() {
+			addrs = append(addrs, node.Addr)
+		}
+	}
+	if !proxy {
+		addrs = append(addrs, host)
+	}
+	key := strings.Join(addrs, "/")
+	if tlsConfig != nil {
+		key = "https://" + key
+	}
+
+	if !upgrade {
+		if pc := h.pool().get(key); pc != nil {
+			resp, err := pc.roundTrip(req, proxy, lastNode.User)
+			if err == nil {
+				return pc, resp, nil
+			}
+			pc.Close()
+			if req.Body != nil && req.Body != http.NoBody {
+				return nil, nil, err
+			}
+		}
+	}
+
+	var cc net.Conn
+	var err error
+	if proxy {
+		cc, err = route.Conn(RetryChainOption(1))
+	} else {
+		cc, err = h.dial(route, host)
+	}
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer cc.Close()
+	if tlsConfig != nil {
+		cc = tls.Client(cc, tlsConfig)
+	}
+	pc := &httpPoolConn{Conn: cc, br: bufio.NewReader(cc), key: key}
+
+	if upgrade {
+		if err := pc.writeRequest(req, proxy, lastNode.User); err != nil {
+			pc.Close()
+			return nil, nil, err
+		}
+		return pc, nil, nil
+	}
+	resp, err := pc.roundTrip(req, proxy, lastNode.User)
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, resp, nil
+}
+
+func (h *httpHandler) pool() *httpConnPool {
+	h.poolOnce.Do(func() {
+		h.connPool = &httpConnPool{conns: make(map[string][]*httpPoolConn)}
+	})
+	return h.connPool
+}
+
+const (
+	httpPoolIdleTimeout     = 90 * time.Second
+	httpPoolMaxIdlePerKey   = 4
+	httpPoolResponseTimeout = 60 * time.Second
+)
 
-	if lastNode.User != nil {
-		s := lastNode.User.String()
-		if _, set := lastNode.User.Password(); !set {
+// httpPoolConn is an upstream connection for the HTTP requests.
+type httpPoolConn struct {
+	net.Conn
+	br    *bufio.Reader
+	key   string
+	timer *time.Timer
+}
+
+// writeRequest writes the request in the proxy form if it is sent to the HTTP proxy.
+func (pc *httpPoolConn) writeRequest(req *http.Request, proxy bool, user *url.Userinfo) error {
+	pc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	defer pc.SetWriteDeadline(time.Time{})
+
+	if !proxy {
+		return req.Write(pc)
+	}
+	if user != nil {
+		s := user.String()
+		if _, set := user.Password(); !set {
 			s += ":"
 		}
 		req.Header.Set("Proxy-Authorization",
 			"Basic "+base64.StdEncoding.EncodeToString([]byte(s)))
+		defer req.Header.Del("Proxy-Authorization")
 	}
+	return req.WriteProxy(pc)
+}
 
-	cc.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	if !req.URL.IsAbs() {
-		req.URL.Scheme = "http" // make sure that the URL is absolute
+func (pc *httpPoolConn) roundTrip(req *http.Request, proxy bool, user *url.Userinfo) (*http.Response, error) {
+	if err := pc.writeRequest(req, proxy, user); err != nil {
+		return nil, err
 	}
-	if err = req.WriteProxy(cc); err != nil {
-		log.Logf("[http] %s -> %s : %s", conn.RemoteAddr(), req.Host, err)
-		return nil
+
+	pc.SetReadDeadline(time.Now().Add(httpPoolResponseTimeout))
+	resp, err := http.ReadResponse(pc.br, req)
+	if err != nil {
+		return nil, err
 	}
-	cc.SetWriteDeadline(time.Time{})
+	pc.SetReadDeadline(time.Time{})
+	return resp, nil
+}
 
-	log.Logf("[http] %s <-> %s", conn.RemoteAddr(), req.Host)
-	transport(conn, cc)
-	log.Logf("[http] %s >-< %s", conn.RemoteAddr(), req.Host)
+// httpConnPool is a pool of the idle upstream connections, the connections are closed after the idle timeout.
+type httpConnPool struct {
+	conns map[string][]*httpPoolConn
+	mux   sync.Mutex
+}
+
+func (p *httpConnPool) get(key string) *httpPoolConn {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	conns := p.conns[key]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if pc.timer.Stop() {
+			p.conns[key] = conns
+			return pc
+		}
+	}
+	delete(p.conns, key)
 	return nil
 }
 
+func (p *httpConnPool) put(pc *httpPoolConn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if len(p.conns[pc.key]) >= httpPoolMaxIdlePerKey {
+		pc.Close()
+		return
+	}
+	pc.timer = time.AfterFunc(httpPoolIdleTimeout, func() {
+		p.remove(pc)
+	})
+	p.conns[pc.key] = append(p.conns[pc.key], pc)
+}
+
+func (p *httpConnPool) remove(pc *httpPoolConn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	conns := p.conns[pc.key]
+	for i := range conns {
+		if conns[i] == pc {
+			p.conns[pc.key] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[pc.key]) == 0 {
+		delete(p.conns, pc.key)
+	}
+	pc.Close()
+}
+
 func basicProxyAuth(proxyAuth string) (username, password string, ok bool) {
 	if proxyAuth == "" {
 		return
@@ -308,20 +645,3 @@ func basicProxyAuth(proxyAuth string) (username, password string, ok bool) {
 
 	return cs[:s], cs[s+1:], true
 }
-
-func authenticate(username, password string, users ...*url.Userinfo) bool {
-	if len(users) == 0 {
-		return true
-	}
-
-	for _, user := range users {
-		u := user.Username()
-		p, _ := user.Password()
-		if (u == username && p == password) ||
-			(u == username && p == "") ||
-			(u == "" && p == password) {
-			return true
-		}
-	}
-	return false
-}
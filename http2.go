@@ -263,6 +263,7 @@ func (h *http2Handler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
 }
 
 func (h *http2Handler) Handle(conn net.Conn) {
@@ -295,32 +296,56 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Proxy-Agent", "gost/"+Version)
 
-	if !Can("tcp", target, h.options.Whitelist, h.options.Blacklist) {
+	u, p, _ := basicProxyAuth(r.Header.Get("Proxy-Authorization"))
+	if Debug && (u != "" || p != "") {
+		log.Logf("[http] %s - %s : Authorization: '%s' '%s'", r.RemoteAddr, target, u, p)
+	}
+	src, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if user := tlsStateUser(r.TLS); user != "" {
+		u = user // authenticated by the client certificate
+	} else if h.options.Authenticator != nil {
+		ip := addrIP(src)
+		// the banned client is always rejected without checking the credentials.
+		banned := h.options.AuthGuard.Banned(ip)
+		id, ok := "", false
+		if !banned {
+			id, ok = authenticate(h.options.Authenticator, u, p)
+		}
+		if !ok {
+			if banned {
+				log.Logf("[http2] %s - %s : banned", r.RemoteAddr, target)
+			} else if u != "" || p != "" {
+				h.options.AuthGuard.Fail(ip, u)
+			}
+			log.Logf("[http2] %s <- %s : proxy authentication required", r.RemoteAddr, target)
+			w.Header().Set("Proxy-Authenticate", "Basic realm=\"gost\"")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		h.options.AuthGuard.Succeed(ip)
+		u = id
+	}
+
+	if !h.options.can("tcp", target, src, u) {
 		log.Logf("[http2] Unauthorized to tcp connect to %s", target)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	if h.options.Bypass.Contains(target) {
+	if h.options.bypass(target) {
 		log.Logf("[http2] [bypass] %s", target)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	u, p, _ := basicProxyAuth(r.Header.Get("Proxy-Authorization"))
-	if Debug && (u != "" || p != "") {
-		log.Logf("[http] %s - %s : Authorization: '%s' '%s'", r.RemoteAddr, target, u, p)
-	}
-	if !authenticate(u, p, h.options.Users...) {
-		log.Logf("[http2] %s <- %s : proxy authentication required", r.RemoteAddr, target)
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"gost\"")
-		w.WriteHeader(http.StatusProxyAuthRequired)
-		return
-	}
-
 	r.Header.Del("Proxy-Authorization")
 	r.Header.Del("Proxy-Connection")
 
+	var su string
+	if u != "" {
+		su = u + "@"
+	}
+
 	cc, err := h.options.Chain.Dial(target,
 		RetryChainOption(h.options.Retries),
 		TimeoutChainOption(h.options.Timeout),
@@ -351,13 +376,13 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 			}
 			defer conn.Close()
 
-			log.Logf("[http2] %s <-> %s : downgrade to HTTP/1.1", r.RemoteAddr, target)
+			log.Logf("[http2] %s%s <-> %s : downgrade to HTTP/1.1", su, r.RemoteAddr, target)
 			transport(conn, cc)
-			log.Logf("[http2] %s >-< %s", r.RemoteAddr, target)
+			log.Logf("[http2] %s%s >-< %s", su, r.RemoteAddr, target)
 			return
 		}
 
-		log.Logf("[http2] %s <-> %s", r.RemoteAddr, target)
+		log.Logf("[http2] %s%s <-> %s", su, r.RemoteAddr, target)
 		errc := make(chan error, 2)
 		go func() {
 			_, err := io.Copy(cc, r.Body)
@@ -372,11 +397,11 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 		case <-errc:
 			// glog.V(LWARNING).Infoln("exit", err)
 		}
-		log.Logf("[http2] %s >-< %s", r.RemoteAddr, target)
+		log.Logf("[http2] %s%s >-< %s", su, r.RemoteAddr, target)
 		return
 	}
 
-	log.Logf("[http2] %s <-> %s", r.RemoteAddr, target)
+	log.Logf("[http2] %s%s <-> %s", su, r.RemoteAddr, target)
 	if err = r.Write(cc); err != nil {
 		log.Logf("[http2] %s -> %s : %s", r.RemoteAddr, target, err)
 		return
@@ -398,7 +423,7 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 	if _, err := io.Copy(flushWriter{w}, resp.Body); err != nil {
 		log.Logf("[http2] %s <- %s : %s", r.RemoteAddr, target, err)
 	}
-	log.Logf("[http2] %s >-< %s", r.RemoteAddr, target)
+	log.Logf("[http2] %s%s >-< %s", su, r.RemoteAddr, target)
 }
 
 type http2Listener struct {
@@ -613,6 +638,7 @@ func (l *h2Listener) upgrade(w http.ResponseWriter, r *http.Request) (*http2Conn
 		w:          flushWriter{w},
 		localAddr:  l.Listener.Addr(),
 		remoteAddr: remoteAddr,
+		tlsState:   r.TLS,
 		closed:     make(chan struct{}),
 	}
 	return conn, nil
@@ -636,6 +662,7 @@ type http2Conn struct {
 	w          io.Writer
 	remoteAddr net.Addr
 	localAddr  net.Addr
+	tlsState   *tls.ConnectionState // the TLS state of the server side connection
 	closed     chan struct{}
 }
 
@@ -6,10 +6,13 @@ import (
 	"crypto/rand"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 )
 
 var httpTestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -125,3 +128,107 @@ func TestHTTPProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPProxyKeepAlive(t *testing.T) {
+	var mux sync.Mutex
+	conns := make(map[string]int) // the number of the requests per upstream connection
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			conns[r.RemoteAddr]++
+			mux.Unlock()
+			io.WriteString(w, name)
+		}))
+	}
+	srv1 := newServer("srv1")
+	defer srv1.Close()
+	srv2 := newServer("srv2")
+	defer srv2.Close()
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler())
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for _, urlStr := range []string{srv1.URL, srv2.URL, srv1.URL, srv2.URL} {
+		req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "srv1"
+		if urlStr == srv2.URL {
+			want = "srv2"
+		}
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", urlStr, b, want)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(conns) != 2 {
+		t.Errorf("got %d upstream connections, want 2: %v", len(conns), conns)
+	}
+}
+
+func TestHTTPProxyIdleTimeout(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler(IdleTimeoutHandlerOption(100 * time.Millisecond)))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpSrv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	// the idle keep-alive connection is closed by the server.
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("the idle connection should be closed, got %v", err)
+	}
+}
@@ -69,6 +69,7 @@ func ParseNode(s string) (node Node, err error) {
 		node.Transport = "tls"
 	case "tcp", "udp": // started from v2.1, tcp and udp are for local port forwarding
 	case "rtcp", "rudp": // rtcp and rudp are for remote port forwarding
+	case "dns": // DNS server
 	case "ohttp": // obfs-http
 	default:
 		node.Transport = "tcp"
@@ -80,6 +81,7 @@ func ParseNode(s string) (node Node, err error) {
 		node.Protocol = "socks5"
 	case "tcp", "udp", "rtcp", "rudp": // port forwarding
 	case "direct", "remote", "forward": // forwarding
+	case "dns": // DNS server
 	case "redirect": // TCP transparent proxy
 	default:
 		node.Protocol = ""
@@ -1,20 +1,31 @@
 package gost
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	glob "github.com/ryanuber/go-glob"
 )
 
+// permissionsMux guards the content of all Permissions, so they can be live reloaded.
+var permissionsMux sync.RWMutex
+
 // Permission is a rule for blacklist and whitelist.
+// The Hosts holds the host patterns and IP addresses, the Networks holds the CIDR entries of the hosts.
+// If the Sources is not empty, the rule only applies to the clients from these networks.
 type Permission struct {
-	Actions StringSet
-	Hosts   StringSet
-	Ports   PortSet
+	Actions  StringSet
+	Hosts    StringSet
+	Networks []*net.IPNet
+	Ports    PortSet
+	Sources  []*net.IPNet
 }
 
 // PortRange specifies the range of port, such as 1000-2000.
@@ -133,6 +144,10 @@ func (ss *StringSet) Contains(subj string) bool {
 type Permissions []Permission
 
 // ParsePermissions parses the s to a Permissions.
+// The permissions are separated by spaces, each permission has the format [actions]:[hosts]:[ports][:sources].
+// The hosts may contain CIDR entries, the IPv6 address and network should be enclosed in brackets,
+// such as [2001:db8::1] and [2001:db8::/32].
+// The optional sources is a comma separated list of IP addresses or CIDR entries of the clients.
 func ParsePermissions(s string) (*Permissions, error) {
 	ps := &Permissions{}
 
@@ -140,23 +155,23 @@ func ParsePermissions(s string) (*Permissions, error) {
 		return &Permissions{}, nil
 	}
 
-	perms := strings.Split(s, " ")
+	perms := strings.Fields(s)
 
 	for _, perm := range perms {
-		parts := strings.Split(perm, ":")
+		parts := splitPermission(perm)
 
 		switch len(parts) {
-		case 3:
+		case 3, 4:
 			actions, err := ParseStringSet(parts[0])
 
 			if err != nil {
 				return nil, fmt.Errorf("action list must look like connect,bind given: %s", parts[0])
 			}
 
-			hosts, err := ParseStringSet(parts[1])
+			hosts, networks, err := parseHosts(parts[1])
 
 			if err != nil {
-				return nil, fmt.Errorf("hosts list must look like google.pl,*.google.com given: %s", parts[1])
+				return nil, fmt.Errorf("hosts list must look like google.pl,*.google.com,10.0.0.0/8 given: %s", parts[1])
 			}
 
 			ports, err := ParsePortSet(parts[2])
@@ -165,21 +180,187 @@ func ParsePermissions(s string) (*Permissions, error) {
 				return nil, fmt.Errorf("ports list must look like 80,8000-9000, given: %s", parts[2])
 			}
 
-			permission := Permission{Actions: *actions, Hosts: *hosts, Ports: *ports}
+			permission := Permission{Actions: *actions, Hosts: hosts, Networks: networks, Ports: *ports}
+
+			if len(parts) == 4 && parts[3] != "*" {
+				sources, err := parseNetworks(parts[3])
+				if err != nil {
+					return nil, fmt.Errorf("sources list must look like 192.168.1.0/24,[::1], given: %s", parts[3])
+				}
+				permission.Sources = sources
+			}
 
 			*ps = append(*ps, permission)
 		default:
-			return nil, fmt.Errorf("permission must have format [actions]:[hosts]:[ports] given: %s", perm)
+			return nil, fmt.Errorf("permission must have format [actions]:[hosts]:[ports][:sources] given: %s", perm)
 		}
 	}
 
 	return ps, nil
 }
 
+// splitPermission splits the permission by colons, the colons in brackets are ignored.
+func splitPermission(s string) (parts []string) {
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHosts parses the comma separated hosts, the CIDR entries are returned as networks.
+func parseHosts(s string) (hosts StringSet, networks []*net.IPNet, err error) {
+	if s == "" {
+		return nil, nil, errors.New("cannot be empty")
+	}
+
+	hosts = StringSet{}
+	for _, host := range strings.Split(s, ",") {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			return nil, nil, errors.New("empty host")
+		}
+		if strings.Contains(host, "/") {
+			_, ipNet, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, nil, err
+			}
+			networks = append(networks, ipNet)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+// parseNetworks parses the comma separated IP addresses and CIDR entries.
+func parseNetworks(s string) (networks []*net.IPNet, err error) {
+	if s == "" {
+		return nil, errors.New("cannot be empty")
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipNet)
+	}
+	return
+}
+
+// permissionRequest is the subject checked by the Permissions.
+type permissionRequest struct {
+	action string
+	host   string
+	port   int
+	src    net.IP          // the client address, it may be nil if unknown.
+	lookup func() []net.IP // resolves the host if it is not an IP address, it may be nil.
+	ips    []net.IP
+	looked bool
+}
+
+func (r *permissionRequest) hostIPs() []net.IP {
+	if r.looked {
+		return r.ips
+	}
+	r.looked = true
+	if ip := net.ParseIP(r.host); ip != nil {
+		r.ips = []net.IP{ip}
+	} else if r.lookup != nil {
+		r.ips = r.lookup()
+	}
+	return r.ips
+}
+
+func (p *Permission) match(r *permissionRequest) bool {
+	if !p.Actions.Contains(r.action) || !p.Ports.Contains(r.port) {
+		return false
+	}
+	if len(p.Sources) > 0 && !networksContain(p.Sources, r.src) {
+		return false
+	}
+	if p.Hosts.Contains(r.host) {
+		return true
+	}
+
+	if !p.hasIPRules() {
+		return false
+	}
+	for _, ip := range r.hostIPs() {
+		if networksContain(p.Networks, ip) {
+			return true
+		}
+		for _, host := range p.Hosts {
+			if hip := net.ParseIP(host); hip != nil && hip.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasIPRules reports whether the hosts of the permission contain IP addresses or networks.
+func (p *Permission) hasIPRules() bool {
+	if len(p.Networks) > 0 {
+		return true
+	}
+	for _, host := range p.Hosts {
+		if net.ParseIP(host) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Can tests whether the given action and host:port is allowed by this Permissions.
 func (ps *Permissions) Can(action string, host string, port int) bool {
-	for _, p := range *ps {
-		if p.Actions.Contains(action) && p.Hosts.Contains(host) && p.Ports.Contains(port) {
+	return ps.can(&permissionRequest{action: action, host: host, port: port})
+}
+
+func (ps *Permissions) can(r *permissionRequest) bool {
+	// the reloading replaces the whole slice, so it is safe to iterate the snapshot without lock.
+	permissionsMux.RLock()
+	perms := *ps
+	permissionsMux.RUnlock()
+
+	for i := range perms {
+		if perms[i].match(r) {
 			return true
 		}
 	}
@@ -187,6 +368,70 @@ func (ps *Permissions) Can(action string, host string, port int) bool {
 	return false
 }
 
+// PermissionsReloader live reloads the content of the Permissions from the config.
+type PermissionsReloader struct {
+	perms  *Permissions
+	period time.Duration
+	mux    sync.RWMutex
+}
+
+// NewPermissionsReloader creates a PermissionsReloader for the Permissions ps.
+func NewPermissionsReloader(ps *Permissions) *PermissionsReloader {
+	return &PermissionsReloader{perms: ps}
+}
+
+// Reload parses config from r, then replaces the content of the Permissions.
+// The config contains the permissions in the format of ParsePermissions, they can be in multiple lines.
+func (pr *PermissionsReloader) Reload(r io.Reader) error {
+	var period time.Duration
+	var rules []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if n := strings.IndexByte(line, '#'); n >= 0 {
+			line = line[:n]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// reload option
+		if ss := strings.Fields(line); len(ss) == 2 && strings.ToLower(ss[0]) == "reload" {
+			period, _ = time.ParseDuration(ss[1])
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ps, err := ParsePermissions(strings.Join(rules, " "))
+	if err != nil {
+		return err
+	}
+
+	pr.mux.Lock()
+	pr.period = period
+	pr.mux.Unlock()
+
+	permissionsMux.Lock()
+	*pr.perms = *ps
+	permissionsMux.Unlock()
+
+	return nil
+}
+
+// Period returns the reload period.
+func (pr *PermissionsReloader) Period() time.Duration {
+	pr.mux.RLock()
+	defer pr.mux.RUnlock()
+
+	return pr.period
+}
+
 func minint(x, y int) int {
 	if x < y {
 		return x
@@ -203,21 +448,33 @@ func maxint(x, y int) int {
 
 // Can tests whether the given action and address is allowed by the whitelist and blacklist.
 func Can(action string, addr string, whitelist, blacklist *Permissions) bool {
-	if !strings.Contains(addr, ":") {
-		addr = addr + ":80"
+	r := newPermissionRequest(action, addr)
+	if r == nil {
+		return false
+	}
+	return canRequest(r, whitelist, blacklist)
+}
+
+func newPermissionRequest(action string, addr string) *permissionRequest {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), "80")
 	}
 	host, strport, err := net.SplitHostPort(addr)
 
 	if err != nil {
-		return false
+		return nil
 	}
 
 	port, err := strconv.Atoi(strport)
 
 	if err != nil {
-		return false
+		return nil
 	}
 
-	return (whitelist == nil || whitelist.Can(action, host, port)) &&
-		(blacklist == nil || !blacklist.Can(action, host, port))
+	return &permissionRequest{action: action, host: host, port: port}
+}
+
+func canRequest(r *permissionRequest, whitelist, blacklist *Permissions) bool {
+	return (whitelist == nil || whitelist.can(r)) &&
+		(blacklist == nil || !blacklist.can(r))
 }
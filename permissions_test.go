@@ -2,7 +2,10 @@ package gost
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 var portRangeTests = []struct {
@@ -150,3 +153,97 @@ func TestPermissionsParse(t *testing.T) {
 		}
 	}
 }
+
+func TestPermissionsParseNetworks(t *testing.T) {
+	ps, err := ParsePermissions("tcp:10.0.0.0/8,[2001:db8::/32],[::1],localhost:80 udp:*:53:192.168.1.0/24,[fe80::1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ps) != 2 {
+		t.Fatalf("should have 2 permissions, got %d", len(*ps))
+	}
+	p := (*ps)[0]
+	if fmt.Sprint(p.Hosts) != "[::1 localhost]" || fmt.Sprint(p.Networks) != "[10.0.0.0/8 2001:db8::/32]" || p.Sources != nil {
+		t.Errorf("wrong permission: %v", p)
+	}
+	p = (*ps)[1]
+	if fmt.Sprint(p.Sources) != "[192.168.1.0/24 fe80::1/128]" {
+		t.Errorf("wrong sources: %v", p.Sources)
+	}
+
+	for _, s := range []string{"tcp:10.0.0.0/33:80", "tcp:*:80:10.0.0.x", "tcp:[::1:80", "tcp:*:80:*:x"} {
+		if _, err := ParsePermissions(s); err == nil {
+			t.Errorf("ParsePermissions(%q) should return error", s)
+		}
+	}
+}
+
+func TestPermissionsCanNetworks(t *testing.T) {
+	whitelist, _ := ParsePermissions("tcp:10.0.0.0/8,[2001:db8::/32],[::1]:* udp:*:53:192.168.1.0/24")
+	opts := &HandlerOptions{
+		Whitelist: whitelist,
+		Hosts:     NewHosts(Host{IP: net.ParseIP("10.1.2.3"), Hostname: "internal.example.com"}),
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 1234}
+
+	var tests = []struct {
+		action string
+		addr   string
+		src    net.Addr
+		can    bool
+	}{
+		{"tcp", "10.1.1.1:80", nil, true},
+		{"tcp", "11.1.1.1:80", nil, false},
+		{"tcp", "[2001:db8::1]:443", nil, true},
+		{"tcp", "[::1]:443", nil, true},
+		{"tcp", "[0:0::1]:443", nil, true},
+		{"tcp", "internal.example.com:80", nil, true},
+		{"tcp", "www.example.com:80", nil, false},
+		{"udp", "8.8.8.8:53", src, true},
+		{"udp", "8.8.8.8:53", &net.TCPAddr{IP: net.ParseIP("192.168.2.1")}, false},
+		{"udp", "8.8.8.8:53", nil, false},
+	}
+	for i, test := range tests {
+		if can := opts.can(test.action, test.addr, test.src, ""); can != test.can {
+			t.Errorf("#%d: %s %s from %v should be %v, got %v", i, test.action, test.addr, test.src, test.can, can)
+		}
+	}
+
+	if !Can("tcp", "10.1.1.1:80", whitelist, nil) || Can("tcp", "internal.example.com:80", whitelist, nil) {
+		t.Error("Can should match the IP rules without resolution")
+	}
+}
+
+func TestPermissionsReload(t *testing.T) {
+	ps := &Permissions{}
+	pr := NewPermissionsReloader(ps)
+	config := `
+# allow the internal network
+tcp:10.0.0.0/8:*
+udp:*:53 # DNS
+reload 10s
+`
+	if err := pr.Reload(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	if pr.Period() != 10*time.Second {
+		t.Errorf("reload period should be 10s, got %v", pr.Period())
+	}
+	if !ps.Can("tcp", "10.0.0.1", 80) || !ps.Can("udp", "8.8.8.8", 53) || ps.Can("tcp", "8.8.8.8", 80) {
+		t.Errorf("wrong permissions: %v", ps)
+	}
+
+	if err := pr.Reload(strings.NewReader("tcp:*:443\n")); err != nil {
+		t.Fatal(err)
+	}
+	if ps.Can("tcp", "10.0.0.1", 80) || !ps.Can("tcp", "8.8.8.8", 443) {
+		t.Errorf("permissions should be reloaded: %v", ps)
+	}
+
+	if err := pr.Reload(strings.NewReader("tcp:*\n")); err == nil {
+		t.Error("invalid config should return error")
+	}
+	if !ps.Can("tcp", "8.8.8.8", 443) {
+		t.Error("permissions should be kept on error")
+	}
+}
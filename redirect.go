@@ -16,6 +16,7 @@ type tcpRedirectHandler struct {
 }
 
 // TCPRedirectHandler creates a server Handler for TCP redirect server.
+// If the original destination is a fake address of the FakeIP option, the chain is dialed by the mapped hostname.
 func TCPRedirectHandler(opts ...HandlerOption) Handler {
 	h := &tcpRedirectHandler{}
 	h.Init(opts...)
@@ -47,21 +48,34 @@ func (h *tcpRedirectHandler) Handle(c net.Conn) {
 	}
 	defer conn.Close()
 
-	log.Logf("[red-tcp] %s -> %s", srcAddr, dstAddr)
+	addr := dstAddr.String()
+	if ip := addrIP(dstAddr); h.options.FakeIP.Contains(ip) {
+		name, ok := h.options.FakeIP.Name(ip)
+		if !ok {
+			log.Logf("[red-tcp] %s -> %s : unknown fake IP", srcAddr, dstAddr)
+			return
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		addr = net.JoinHostPort(name, port)
+	}
+
+	log.Logf("[red-tcp] %s -> %s", srcAddr, addr)
 
-	cc, err := h.options.Chain.Dial(dstAddr.String(),
+	cc, err := h.options.Chain.Dial(addr,
 		RetryChainOption(h.options.Retries),
 		TimeoutChainOption(h.options.Timeout),
+		HostsChainOption(h.options.Hosts),
+		ResolverChainOption(h.options.Resolver),
 	)
 	if err != nil {
-		log.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
+		log.Logf("[red-tcp] %s -> %s : %s", srcAddr, addr, err)
 		return
 	}
 	defer cc.Close()
 
-	log.Logf("[red-tcp] %s <-> %s", srcAddr, dstAddr)
+	log.Logf("[red-tcp] %s <-> %s", srcAddr, addr)
 	transport(conn, cc)
-	log.Logf("[red-tcp] %s >-< %s", srcAddr, dstAddr)
+	log.Logf("[red-tcp] %s >-< %s", srcAddr, addr)
 }
 
 func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Addr, c *net.TCPConn, err error) {
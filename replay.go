@@ -0,0 +1,95 @@
+package gost
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// replayFilterKey is the random key of the hash of the replay filters,
+// so the positions of the items in the filters can not be predicted to make the false positives.
+var replayFilterKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// replayFilter detects the replayed salts or nonces of the handshakes.
+// It is a pair of rotating bloom filters: when the current filter is full,
+// it becomes the previous one and a new filter is used, so the memory is bounded,
+// and at least the last capacity items are remembered.
+type replayFilter struct {
+	capacity int
+	k        int    // the number of the hash functions
+	m        uint64 // the number of the bits of each filter
+	cur      []uint64
+	prev     []uint64
+	count    int // the number of the items in the current filter
+	mux      sync.Mutex
+}
+
+// newReplayFilter creates a replayFilter of the capacity items per filter with the false positive rate.
+func newReplayFilter(capacity int, fpRate float64) *replayFilter {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := int(float64(m)/float64(capacity)*math.Ln2 + 0.5)
+	if k < 1 {
+		k = 1
+	}
+	return &replayFilter{
+		capacity: capacity,
+		k:        k,
+		m:        m,
+		cur:      make([]uint64, m/64),
+	}
+}
+
+// Check reports whether b has been seen, b is added to the filter if it is not.
+func (f *replayFilter) Check(b []byte) bool {
+	if f == nil {
+		return false
+	}
+
+	h := hmac.New(sha256.New, replayFilterKey)
+	h.Write(b)
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.test(f.cur, h1, h2) || (f.prev != nil && f.test(f.prev, h1, h2)) {
+		return true
+	}
+
+	if f.count >= f.capacity {
+		f.prev = f.cur
+		f.cur = make([]uint64, f.m/64)
+		f.count = 0
+	}
+	for i := 0; i < f.k; i++ {
+		n := (h1 + uint64(i)*h2) % f.m
+		f.cur[n/64] |= 1 << (n % 64)
+	}
+	f.count++
+	return false
+}
+
+func (f *replayFilter) test(bits []uint64, h1, h2 uint64) bool {
+	for i := 0; i < f.k; i++ {
+		n := (h1 + uint64(i)*h2) % f.m
+		if bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
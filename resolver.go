@@ -3,23 +3,59 @@ package gost
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-log/log"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 var (
 	// DefaultResolverTimeout is the default timeout for name resolution.
 	DefaultResolverTimeout = 30 * time.Second
-	// DefaultResolverTTL is the default cache TTL for name resolution.
+	// DefaultResolverTTL is the default max cache TTL for name resolution.
 	DefaultResolverTTL = 60 * time.Second
+	// DefaultResolverCacheSize is the default max number of the cached replies for name resolution.
+	DefaultResolverCacheSize = 1024
+)
+
+// The modes of the resolver to use the name servers.
+const (
+	// ResolverModeSequential queries the name servers in order, until one of them replies.
+	ResolverModeSequential = "sequential"
+	// ResolverModeParallel queries all the name servers at the same time, the first successful reply wins.
+	ResolverModeParallel = "parallel"
+	// ResolverModeRoundRobin queries the name servers in order, starting from the next one for each query.
+	ResolverModeRoundRobin = "round-robin"
+)
+
+// The address family preferences of the resolver.
+const (
+	// ResolverPreferIPv4 resolves both IPv4 and IPv6 addresses, the IPv4 addresses come first.
+	ResolverPreferIPv4 = "prefer-ipv4"
+	// ResolverPreferIPv6 resolves both IPv4 and IPv6 addresses, the IPv6 addresses come first.
+	ResolverPreferIPv6 = "prefer-ipv6"
+	// ResolverIPv4Only resolves the IPv4 addresses only.
+	ResolverIPv4Only = "ipv4-only"
+	// ResolverIPv6Only resolves the IPv6 addresses only.
+	ResolverIPv6Only = "ipv6-only"
 )
 
 // Resolver is a name resolver for domain name.
@@ -29,6 +65,13 @@ type Resolver interface {
 	Resolve(host string) ([]net.IP, error)
 }
 
+// Exchanger is the optional interface of the Resolver which exchanges the raw DNS messages with the name servers,
+// it is used by the DNS server to answer all types of queries.
+type Exchanger interface {
+	// Exchange sends the query message and returns the reply message.
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
 // ReloadResolver is resolover that support live reloading
 type ReloadResolver interface {
 	Resolver
@@ -36,47 +79,233 @@ type ReloadResolver interface {
 }
 
 // NameServer is a name server.
-// Currently supported protocol: TCP, UDP and TLS.
+// Currently supported protocol: TCP, UDP, TLS (DNS-over-TLS) and HTTPS (DNS-over-HTTPS, RFC 8484).
+// For HTTPS, the Addr is the URL of the server, such as https://1.1.1.1/dns-query.
+//
+// The certificate of the TLS and HTTPS server is always verified,
+// against the Hostname, or the host of the Addr if the Hostname is empty.
+//
+// The name servers with Domains form the split-horizon groups: a name is resolved by the name servers
+// of the longest domain suffix it matches, or by the default name servers without Domains if it matches none.
 type NameServer struct {
 	Addr     string
 	Protocol string
-	Hostname string // for TLS handshake verification
+	Hostname string         // for TLS handshake verification
+	CAs      *x509.CertPool // the root CAs for TLS handshake verification, the system roots are used if it is nil
+	Pins     []string       // the optional SHA256 pins of the server public key, in the format of sha256/base64
+	Method   string         // the HTTP method for HTTPS, GET or POST (default)
+	Domains  []string       // the domain suffixes the name server is used for, it is used for the other domains if empty
 }
 
 func (ns NameServer) String() string {
 	addr := ns.Addr
 	prot := ns.Protocol
 	host := ns.Hostname
-	if _, port, _ := net.SplitHostPort(addr); port == "" {
-		addr = net.JoinHostPort(addr, "53")
-	}
 	if prot == "" {
 		prot = "udp"
 	}
+	if strings.ToLower(prot) == "https" {
+		return fmt.Sprintf("%s/%s %s", ns.url(), prot, host)
+	}
+	if _, port, _ := net.SplitHostPort(addr); port == "" {
+		addr = net.JoinHostPort(addr, "53")
+	}
 	return fmt.Sprintf("%s/%s %s", addr, prot, host)
 }
 
-type resolverCacheItem struct {
-	IPs []net.IP
-	ts  int64
+// url returns the URL of the HTTPS server.
+func (ns NameServer) url() string {
+	s := ns.Addr
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	if u, err := url.Parse(s); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/dns-query"
+		s = u.String()
+	}
+	return s
+}
+
+// tlsConfig returns the TLS config for the TLS or HTTPS server.
+func (ns NameServer) tlsConfig() *tls.Config {
+	serverName := ns.Hostname
+	if serverName == "" {
+		addr := ns.Addr
+		if strings.ToLower(ns.Protocol) == "https" {
+			if u, err := url.Parse(ns.url()); err == nil {
+				addr = u.Host
+			}
+		}
+		serverName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+	}
+	serverName = strings.Trim(serverName, "[]")
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    ns.CAs,
+	}
+	if len(ns.Pins) > 0 {
+		pins := ns.Pins
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if matchPublicKeyPins(cert, pins) {
+						return nil
+					}
+				}
+			}
+			return errors.New("no public key matches the pins")
+		}
+	}
+	return cfg
+}
+
+// matchDomain returns the length of the longest domain suffix of the name server which the name matches,
+// it returns 0 if the name server has no domains, or -1 if the name matches none of the domains.
+func (ns NameServer) matchDomain(name string) int {
+	if len(ns.Domains) == 0 {
+		return 0
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	n := -1
+	for _, domain := range ns.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain == "" {
+			continue
+		}
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > n {
+			n = len(domain)
+		}
+	}
+	return n
+}
+
+// matchPublicKeyPins reports whether the SHA256 hash of the public key of cert is in pins.
+func matchPublicKeyPins(cert *x509.Certificate, pins []string) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	for _, p := range pins {
+		if strings.TrimPrefix(p, "sha256/") == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNameServer parses the name server from the fields in the format of
+// 'address [protocol] [hostname] [option=value ...]',
+// the protocol is HTTPS if the address is an https URL.
+// The options are: ca, the file of the root CAs in PEM format; pin, the public key pin (repeatable);
+// method, the HTTP method for HTTPS; domain, the domain suffix the name server is used for (repeatable).
+func ParseNameServer(fields ...string) (ns NameServer, err error) {
+	var args []string
+	for _, s := range fields {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || strings.Contains(kv[0], "/") {
+			args = append(args, s)
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "ca":
+			data, err := ioutil.ReadFile(kv[1])
+			if err != nil {
+				return ns, err
+			}
+			ns.CAs = x509.NewCertPool()
+			if !ns.CAs.AppendCertsFromPEM(data) {
+				return ns, fmt.Errorf("no certificates in %s", kv[1])
+			}
+		case "pin":
+			ns.Pins = append(ns.Pins, kv[1])
+		case "method":
+			ns.Method = strings.ToUpper(kv[1])
+		case "domain":
+			ns.Domains = append(ns.Domains, kv[1])
+		default:
+			return ns, fmt.Errorf("unknown option %s", kv[0])
+		}
+	}
+	if len(args) == 0 {
+		return ns, errors.New("missing address")
+	}
+
+	ns.Addr = args[0]
+	if len(args) > 1 {
+		ns.Protocol = args[1]
+	}
+	if len(args) > 2 {
+		ns.Hostname = args[2]
+	}
+	if ns.Protocol == "" && strings.HasPrefix(strings.ToLower(ns.Addr), "https://") {
+		ns.Protocol = "https"
+	}
+	return
 }
 
 type resolver struct {
-	Resolver *net.Resolver
+	Servers   []NameServer
+	Chain     *Chain // the queries to the name servers are sent through the chain
+	Timeout   time.Duration
+	TTL       time.Duration // the max cache TTL of the records, the cache is disabled if it is negative
+	MinTTL    time.Duration // the min cache TTL of the records
+	CacheSize int           // the max number of the cached replies
+	Prefetch  bool          // refresh the cached reply in background before it expires
+	Rotate    bool          // rotate the order of the addresses returned by Resolve
+	Mode      string        // the mode to use the name servers, sequential (default), parallel or round-robin
+	Prefer    string        // the address family preference, prefer-ipv4 (default), prefer-ipv6, ipv4-only or ipv6-only
+	cache     *dnsCache
+	rotation  uint32
+	next      uint32 // the next name server for the round-robin mode
+	period    time.Duration
+	clients   map[string]*http.Client // the HTTP clients for the HTTPS servers
+	mux       sync.RWMutex
+}
+
+// resolverOptions are the options of the resolver which can be changed by Reload.
+type resolverOptions struct {
 	Servers  []NameServer
-	mCache   *sync.Map
 	Timeout  time.Duration
 	TTL      time.Duration
-	period   time.Duration
+	MinTTL   time.Duration
+	Prefetch bool
+	Rotate   bool
+	Mode     string
+	Prefer   string
+}
+
+// options returns the current options of the resolver.
+func (r *resolver) options() resolverOptions {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return resolverOptions{
+		Servers:  r.Servers,
+		Timeout:  r.Timeout,
+		TTL:      r.TTL,
+		MinTTL:   r.MinTTL,
+		Prefetch: r.Prefetch,
+		Rotate:   r.Rotate,
+		Mode:     r.Mode,
+		Prefer:   r.Prefer,
+	}
 }
 
 // NewResolver create a new Resolver with the given name servers and resolution timeout.
 func NewResolver(timeout, ttl time.Duration, servers ...NameServer) ReloadResolver {
+	return NewChainResolver(nil, timeout, ttl, servers...)
+}
+
+// NewChainResolver creates a new Resolver which sends the queries to the name servers through the chain.
+// The UDP queries are sent by the UDP tunnel of the SOCKS5 proxy if it is the last node of the chain, otherwise by TCP.
+func NewChainResolver(chain *Chain, timeout, ttl time.Duration, servers ...NameServer) ReloadResolver {
 	r := &resolver{
 		Servers: servers,
+		Chain:   chain,
 		Timeout: timeout,
 		TTL:     ttl,
-		mCache:  &sync.Map{},
 	}
 	r.init()
 	return r
@@ -89,112 +318,635 @@ func (r *resolver) init() {
 	if r.TTL == 0 {
 		r.TTL = DefaultResolverTTL
 	}
-
-	r.Resolver = &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
-			for _, ns := range r.Servers {
-				conn, err = r.dial(ctx, ns)
-				if err == nil {
-					break
-				}
-				log.Logf("[resolver] %s : %s", ns, err)
-			}
-			return
-		},
+	if r.CacheSize <= 0 {
+		r.CacheSize = DefaultResolverCacheSize
 	}
+	r.cache = newDNSCache(r.CacheSize)
 }
 
 func (r *resolver) dial(ctx context.Context, ns NameServer) (net.Conn, error) {
-	var d net.Dialer
-
 	addr := ns.Addr
 	if _, port, _ := net.SplitHostPort(addr); port == "" {
 		addr = net.JoinHostPort(addr, "53")
 	}
 	switch strings.ToLower(ns.Protocol) {
 	case "tcp":
-		return d.DialContext(ctx, "tcp", addr)
+		return r.dialTCP(ctx, addr)
 	case "tls":
-		conn, err := d.DialContext(ctx, "tcp", addr)
+		conn, err := r.dialTCP(ctx, addr)
 		if err != nil {
 			return nil, err
 		}
-		cfg := &tls.Config{
-			ServerName: ns.Hostname,
-		}
-		if cfg.ServerName == "" {
-			cfg.InsecureSkipVerify = true
-		}
-		return tls.Client(conn, cfg), nil
+		return tls.Client(conn, ns.tlsConfig()), nil
+	case "https":
+		return &dohConn{
+			ctx:    ctx,
+			client: r.httpClient(ns),
+			url:    ns.url(),
+			method: ns.Method,
+		}, nil
 	case "udp":
 		fallthrough
 	default:
+		return r.dialUDP(ctx, addr)
+	}
+}
+
+// dialTCP connects to the name server through the chain, or directly if the chain is empty.
+func (r *resolver) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if r.Chain.IsEmpty() {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	timeout := r.options().Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return r.Chain.Dial(addr, TimeoutChainOption(timeout))
+}
+
+// dialUDP connects to the name server directly if the chain is empty.
+// If the last node of the chain is a plain SOCKS5 proxy, the standard UDP ASSOCIATE is used,
+// and for the other SOCKS5 nodes, which are gost servers over the gost transports, the gost UDP tunnel is used.
+// It falls back to TCP if the UDP relay is not available.
+func (r *resolver) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if r.Chain.IsEmpty() {
+		var d net.Dialer
 		return d.DialContext(ctx, "udp", addr)
 	}
+
+	node := r.Chain.LastNode()
+	if node.Protocol == "socks5" {
+		var conn net.Conn
+		var err error
+		if node.Transport == "" || node.Transport == "tcp" {
+			conn, err = dialSOCKS5UDPConn(r.Chain, addr)
+		} else {
+			var cc net.Conn
+			if cc, err = getSOCKS5UDPTunnel(r.Chain, nil); err == nil {
+				conn = &udpTunnelConn{Conn: cc, raddr: addr}
+			}
+		}
+		if err == nil {
+			return conn, nil
+		}
+		log.Logf("[resolver] %s : %s, fall back to TCP", addr, err)
+	}
+	return r.dialTCP(ctx, addr)
 }
 
+// httpClient returns the HTTP client for the HTTPS server, the clients are reused for the keep-alive connections.
+// The clients are indexed by the server and the verification settings, as they are part of the TLS config.
+func (r *resolver) httpClient(ns NameServer) *http.Client {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	key := fmt.Sprintf("%s %p %s", ns, ns.CAs, strings.Join(ns.Pins, ","))
+	if client := r.clients[key]; client != nil {
+		return client
+	}
+	if r.clients == nil {
+		r.clients = make(map[string]*http.Client)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return r.dialTCP(ctx, addr)
+			},
+			TLSClientConfig:     ns.tlsConfig(),
+			TLSHandshakeTimeout: r.Timeout,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 4,
+		},
+	}
+	r.clients[key] = client
+	return client
+}
+
+// resolverPrefer returns the address family preference of the Resolver, it is empty if r has no preference.
+func resolverPrefer(r Resolver) string {
+	if rr, ok := r.(*resolver); ok && rr != nil {
+		return rr.options().Prefer
+	}
+	return ""
+}
+
+// Resolve queries the A and AAAA records of the name by Exchange, so the replies are cached in the same way.
+// The addresses are filtered and ordered by the Prefer, the order of each address family is rotated if Rotate is true,
+// so the first address is the one to connect to.
 func (r *resolver) Resolve(name string) (ips []net.IP, err error) {
 	if r == nil {
 		return
 	}
-	timeout := r.Timeout
 
 	if ip := net.ParseIP(name); ip != nil {
 		return []net.IP{ip}, nil
 	}
 
-	ips = r.loadCache(name)
-	if len(ips) > 0 {
+	opts := r.options()
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	var types []dnsmessage.Type
+	switch strings.ToLower(opts.Prefer) {
+	case ResolverIPv4Only:
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case ResolverIPv6Only:
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case ResolverPreferIPv6:
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	default:
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+
+	results := make([][]net.IP, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i := range types {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = r.lookup(ctx, name, types[i])
+		}(i)
+	}
+	wg.Wait()
+
+	n := atomic.AddUint32(&r.rotation, 1)
+	for _, result := range results {
+		if opts.Rotate && len(result) > 1 {
+			k := int(n % uint32(len(result)))
+			result = append(append([]net.IP(nil), result[k:]...), result[:k]...)
+		}
+		ips = append(ips, result...)
+	}
+	if len(ips) == 0 {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+
+	if Debug {
+		log.Logf("[resolver] %s %v", name, ips)
+	}
+	return
+}
+
+// lookup queries the records of the name with the type A or AAAA, and returns the addresses in the answers.
+func (r *resolver) lookup(ctx context.Context, name string, typ dnsmessage.Type) ([]net.IP, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true}, // the ID is set by exchange
+		Questions: []dnsmessage.Question{{Name: name, Type: typ, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := r.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	hdr, err := p.Start(reply)
+	if err != nil {
+		return nil, err
+	}
+	switch hdr.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(name, ".")}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", hdr.RCode), Name: strings.TrimSuffix(name, ".")}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	// the addresses of the CNAME target are in the answers as well.
+	var ips []net.IP
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Type != typ || h.Class != dnsmessage.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rr, err := p.Answer()
+		if err != nil {
+			return nil, err
+		}
+		switch rr := rr.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte(nil), rr.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte(nil), rr.AAAA[:]...)))
+		}
+	}
+	return ips, nil
+}
+
+// Exchange sends the query message to the name servers in order, and returns the first successful reply.
+// The replies are cached for the TTL of the records clamped by the MinTTL and TTL,
+// including the negative replies, and the TTLs in the cached reply are decreased by the time since it was cached.
+// If Prefetch is true, the cached reply is refreshed in background in the last tenth of its TTL.
+func (r *resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := dnsCacheKey(query, q)
+
+	if reply, refresh := r.loadCache(key, hdr.ID); reply != nil {
 		if Debug {
-			log.Logf("[resolver] cache hit: %s %v", name, ips)
+			log.Logf("[resolver] cache hit: %s %s", q.Name, dnsTypeString(q.Type))
 		}
-		return
+		if refresh && r.options().Prefetch {
+			go r.prefetch(key, q.Name, append([]byte(nil), query...))
+		}
+		return reply, nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
 
-	addrs, err := r.Resolver.LookupIPAddr(ctx, name)
-	for _, addr := range addrs {
-		ips = append(ips, addr.IP)
+	reply, err := r.exchangeServers(ctx, q.Name, query)
+	if err != nil {
+		return nil, err
 	}
-	r.storeCache(name, ips)
-	if len(ips) > 0 && Debug {
-		log.Logf("[resolver] %s %v", name, ips)
+	r.storeCache(key, reply)
+	return reply, nil
+}
+
+// dnsCacheKey returns the cache key of the query with the question q.
+// The reply depends on the CD bit and the EDNS0 OPT record with the DO bit of the query,
+// such as the unvalidated answers and the DNSSEC records, so they are part of the key.
+func dnsCacheKey(query []byte, q dnsmessage.Question) string {
+	key := fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Type, q.Class)
+	if query[3]&0x10 != 0 {
+		key += "/cd"
+	}
+	dnsWalkRecords(query, func(section int, typ uint16, off int) {
+		if section == 3 && typ == dnsTypeOPT {
+			key += "/opt"
+			// the DO bit is the first bit of the flags in the TTL of the OPT record.
+			if dnsGetTTL(query, off)&0x8000 != 0 {
+				key += "/do"
+			}
+		}
+	})
+	return key
+}
+
+// exchangeServers exchanges the query of the name with the name servers for it by the Mode.
+func (r *resolver) exchangeServers(ctx context.Context, name string, query []byte) (reply []byte, err error) {
+	opts := r.options()
+	servers := serversFor(opts.Servers, name)
+	if len(servers) == 0 {
+		return nil, errors.New("no name server")
+	}
+
+	switch strings.ToLower(opts.Mode) {
+	case ResolverModeParallel:
+		return r.exchangeParallel(ctx, servers, query)
+	case ResolverModeRoundRobin:
+		n := int((atomic.AddUint32(&r.next, 1) - 1) % uint32(len(servers)))
+		servers = append(append([]NameServer(nil), servers[n:]...), servers[:n]...)
+	}
+
+	for _, ns := range servers {
+		reply, err = r.exchange(ctx, ns, query)
+		if err == nil {
+			return
+		}
+		log.Logf("[resolver] %s : %s", ns, err)
 	}
 	return
 }
 
-func (r *resolver) loadCache(name string) []net.IP {
-	ttl := r.TTL
-	if ttl < 0 {
-		return nil
+// serversFor returns the name servers in nss of the longest domain suffix which the name matches,
+// or the default name servers if it matches none.
+func serversFor(nss []NameServer, name string) (servers []NameServer) {
+	longest := -1
+	for _, ns := range nss {
+		n := ns.matchDomain(name)
+		if n < 0 || n < longest {
+			continue
+		}
+		if n > longest {
+			longest = n
+			servers = nil
+		}
+		servers = append(servers, ns)
 	}
+	return
+}
+
+// exchangeParallel sends the query to all the name servers at the same time, and returns the first successful reply,
+// the other queries are canceled.
+func (r *resolver) exchangeParallel(ctx context.Context, servers []NameServer, query []byte) (reply []byte, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if v, ok := r.mCache.Load(name); ok {
-		item, _ := v.(*resolverCacheItem)
-		if item == nil || time.Since(time.Unix(item.ts, 0)) > ttl {
-			return nil
+	type result struct {
+		reply []byte
+		err   error
+	}
+	ch := make(chan result, len(servers))
+	for _, ns := range servers {
+		go func(ns NameServer) {
+			reply, err := r.exchange(ctx, ns, query)
+			if err != nil && ctx.Err() == nil {
+				log.Logf("[resolver] %s : %s", ns, err)
+			}
+			ch <- result{reply, err}
+		}(ns)
+	}
+
+	for range servers {
+		res := <-ch
+		if res.err == nil {
+			return res.reply, nil
 		}
-		return item.IPs
+		err = res.err
 	}
+	return nil, err
+}
 
-	return nil
+// prefetch refreshes the cached reply of the query.
+func (r *resolver) prefetch(key, name string, query []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options().Timeout)
+	defer cancel()
+
+	reply, err := r.exchangeServers(ctx, name, query)
+	if err != nil {
+		return
+	}
+	if Debug {
+		log.Logf("[resolver] prefetch: %s", key)
+	}
+	r.storeCache(key, reply)
+}
+
+// exchange exchanges the query message with the name server.
+// The query is sent with a random ID (or 0 for HTTPS as recommended by RFC 8484),
+// and the ID of the query is restored in the reply.
+func (r *resolver) exchange(ctx context.Context, ns NameServer, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errDNSInvalidMessage
+	}
+	msg := append([]byte(nil), query...)
+	if strings.ToLower(ns.Protocol) == "https" {
+		msg[0], msg[1] = 0, 0
+	} else if _, err := rand.Read(msg[:2]); err != nil {
+		return nil, err
+	}
+
+	reply, err := r.exchangeMsg(ctx, ns, msg)
+	if err != nil {
+		return nil, err
+	}
+	reply[0], reply[1] = query[0], query[1]
+	return reply, nil
+}
+
+// exchangeMsg exchanges the message with the name server, the reply is matched by the ID and the question,
+// the query is retried over TCP if the UDP reply is truncated.
+func (r *resolver) exchangeMsg(ctx context.Context, ns NameServer, query []byte) ([]byte, error) {
+	conn, err := r.dial(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	_, packet := conn.(net.PacketConn)
+	if packet {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+	} else if err = writeDNSMessage(conn, query); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 65535)
+	for {
+		var reply []byte
+		if packet {
+			n, err := conn.Read(b)
+			if err != nil {
+				return nil, err
+			}
+			reply = b[:n]
+		} else if reply, err = readDNSMessage(conn); err != nil {
+			return nil, err
+		}
+
+		if !dnsReplyMatch(query, reply) {
+			if packet {
+				continue // not the reply of the query
+			}
+			return nil, errDNSInvalidMessage
+		}
+		if packet && reply[2]&0x02 != 0 { // truncated
+			ns.Protocol = "tcp"
+			return r.exchangeMsg(ctx, ns, query)
+		}
+		return append([]byte(nil), reply...), nil
+	}
+}
+
+// dnsReplyMatch reports whether the reply is the reply of the query, by the ID and the question.
+func dnsReplyMatch(query, reply []byte) bool {
+	if len(reply) < 12 || reply[0] != query[0] || reply[1] != query[1] || reply[2]&0x80 == 0 {
+		return false
+	}
+	var qp, rp dnsmessage.Parser
+	if _, err := qp.Start(query); err != nil {
+		return false
+	}
+	q, err := qp.Question()
+	if err != nil {
+		return false
+	}
+	if _, err := rp.Start(reply); err != nil {
+		return false
+	}
+	rq, err := rp.Question()
+	if err != nil {
+		return false
+	}
+	return rq.Type == q.Type && rq.Class == q.Class && strings.EqualFold(rq.Name, q.Name)
 }
 
-func (r *resolver) storeCache(name string, ips []net.IP) {
-	ttl := r.TTL
-	if ttl < 0 || name == "" || len(ips) == 0 {
+// loadCache returns the cached reply with the id, refresh reports whether the reply should be prefetched.
+func (r *resolver) loadCache(key string, id uint16) (reply []byte, refresh bool) {
+	if r.options().TTL < 0 {
 		return
 	}
-	r.mCache.Store(name, &resolverCacheItem{
-		IPs: ips,
-		ts:  time.Now().Unix(),
-	})
+
+	msg, age, refresh := r.getCache().get(key)
+	if msg == nil {
+		return
+	}
+	reply = append([]byte(nil), msg...)
+	reply[0], reply[1] = byte(id>>8), byte(id)
+	dnsDecreaseTTL(reply, uint32(age/time.Second))
+	return
+}
+
+// storeCache caches the reply for the TTL of the records clamped by the MinTTL and TTL.
+func (r *resolver) storeCache(key string, reply []byte) {
+	opts := r.options()
+	if opts.TTL < 0 {
+		return
+	}
+	v, ok := dnsCacheTTL(reply)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(v) * time.Second
+	if ttl < opts.MinTTL {
+		ttl = opts.MinTTL
+	}
+	if opts.TTL > 0 && ttl > opts.TTL {
+		ttl = opts.TTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	r.getCache().set(key, reply, ttl)
+}
+
+func (r *resolver) getCache() *dnsCache {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.cache == nil {
+		r.cache = newDNSCache(r.CacheSize)
+	}
+	return r.cache
 }
 
+// dnsCache is an LRU cache of the DNS reply messages, each message is cached for its own TTL.
+type dnsCache struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+	mux   sync.Mutex
+}
+
+type dnsCacheItem struct {
+	key       string
+	msg       []byte
+	ttl       time.Duration
+	ts        time.Time
+	refreshed bool
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the message of the key and the time since it was cached, or nil if it is expired.
+// refresh is true for the first get in the last tenth of the TTL.
+func (c *dnsCache) get(key string) (msg []byte, age time.Duration, refresh bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e := c.items[key]
+	if e == nil {
+		return
+	}
+	item := e.Value.(*dnsCacheItem)
+	age = time.Since(item.ts)
+	if age >= item.ttl {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return nil, 0, false
+	}
+	c.ll.MoveToFront(e)
+
+	if !item.refreshed && item.ttl-age <= item.ttl/10 {
+		item.refreshed = true
+		refresh = true
+	}
+	return item.msg, age, refresh
+}
+
+// set caches the message for the ttl, the least recently used message is evicted if the cache is full.
+func (c *dnsCache) set(key string, msg []byte, ttl time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	item := &dnsCacheItem{
+		key: key,
+		msg: msg,
+		ttl: ttl,
+		ts:  time.Now(),
+	}
+	if e := c.items[key]; e != nil {
+		e.Value = item
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(item)
+	for c.size > 0 && c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*dnsCacheItem).key)
+	}
+}
+
+// len returns the number of the cached messages.
+func (c *dnsCache) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.ll.Len()
+}
+
+// Reload reloads the options and the name servers, one per line.
+// A line of the domain suffixes in brackets, such as [example.com, example.org], starts a split-horizon group,
+// the name servers after it are used for the domains, until the next group, [default] starts the default group.
+// The name servers before any group are in the default group.
 func (r *resolver) Reload(rd io.Reader) error {
 	var nss []NameServer
+	var domains []string
+
+	r.mux.RLock()
+	opts := resolverOptions{
+		Timeout:  r.Timeout,
+		TTL:      r.TTL,
+		MinTTL:   r.MinTTL,
+		Prefetch: r.Prefetch,
+		Rotate:   r.Rotate,
+		Mode:     r.Mode,
+		Prefer:   r.Prefer,
+	}
+	cacheSize, period := r.CacheSize, r.period
+	r.mux.RUnlock()
 
 	scanner := bufio.NewScanner(rd)
 	for scanner.Scan() {
@@ -207,6 +959,15 @@ func (r *resolver) Reload(rd io.Reader) error {
 		if line == "" {
 			continue
 		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			domains = nil
+			for _, s := range strings.FieldsFunc(line[1:len(line)-1], func(c rune) bool { return c == ',' || c == ' ' }) {
+				if strings.ToLower(s) != "default" {
+					domains = append(domains, s)
+				}
+			}
+			continue
+		}
 		var ss []string
 		for _, s := range strings.Split(line, " ") {
 			if s = strings.TrimSpace(s); s != "" {
@@ -221,34 +982,66 @@ func (r *resolver) Reload(rd io.Reader) error {
 		if len(ss) >= 2 {
 			// timeout option
 			if strings.ToLower(ss[0]) == "timeout" {
-				r.Timeout, _ = time.ParseDuration(ss[1])
+				opts.Timeout, _ = time.ParseDuration(ss[1])
 				continue
 			}
 
 			// ttl option
 			if strings.ToLower(ss[0]) == "ttl" {
-				r.TTL, _ = time.ParseDuration(ss[1])
+				opts.TTL, _ = time.ParseDuration(ss[1])
+				continue
+			}
+
+			// minttl option
+			if strings.ToLower(ss[0]) == "minttl" {
+				opts.MinTTL, _ = time.ParseDuration(ss[1])
+				continue
+			}
+
+			// cachesize option
+			if strings.ToLower(ss[0]) == "cachesize" {
+				cacheSize, _ = strconv.Atoi(ss[1])
+				continue
+			}
+
+			// prefetch option
+			if strings.ToLower(ss[0]) == "prefetch" {
+				opts.Prefetch, _ = strconv.ParseBool(ss[1])
+				continue
+			}
+
+			// rotate option
+			if strings.ToLower(ss[0]) == "rotate" {
+				opts.Rotate, _ = strconv.ParseBool(ss[1])
+				continue
+			}
+
+			// mode option
+			if strings.ToLower(ss[0]) == "mode" {
+				opts.Mode = strings.ToLower(ss[1])
+				continue
+			}
+
+			// prefer option
+			if strings.ToLower(ss[0]) == "prefer" {
+				opts.Prefer = strings.ToLower(ss[1])
 				continue
 			}
 
 			// reload option
 			if strings.ToLower(ss[0]) == "reload" {
-				r.period, _ = time.ParseDuration(ss[1])
+				period, _ = time.ParseDuration(ss[1])
 				continue
 			}
 		}
 
-		var ns NameServer
-		switch len(ss) {
-		case 1:
-			ns.Addr = ss[0]
-		case 2:
-			ns.Addr = ss[0]
-			ns.Protocol = ss[1]
-		default:
-			ns.Addr = ss[0]
-			ns.Protocol = ss[1]
-			ns.Hostname = ss[2]
+		ns, err := ParseNameServer(ss...)
+		if err != nil {
+			log.Logf("[resolver] %s: %v", line, err)
+			continue
+		}
+		if len(ns.Domains) == 0 {
+			ns.Domains = domains
 		}
 		nss = append(nss, ns)
 	}
@@ -256,11 +1049,37 @@ func (r *resolver) Reload(rd io.Reader) error {
 		return err
 	}
 
+	r.mux.Lock()
 	r.Servers = nss
+	r.Timeout = opts.Timeout
+	r.TTL = opts.TTL
+	r.MinTTL = opts.MinTTL
+	r.CacheSize = cacheSize
+	r.Prefetch = opts.Prefetch
+	r.Rotate = opts.Rotate
+	r.Mode = opts.Mode
+	r.Prefer = opts.Prefer
+	r.period = period
+	for _, client := range r.clients {
+		if t, ok := client.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	r.clients = nil
+	// the cached replies may be from the old name servers.
+	if r.CacheSize <= 0 {
+		r.CacheSize = DefaultResolverCacheSize
+	}
+	r.cache = newDNSCache(r.CacheSize)
+	r.mux.Unlock()
+
 	return nil
 }
 
 func (r *resolver) Period() time.Duration {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
 	return r.period
 }
 
@@ -269,12 +1088,130 @@ func (r *resolver) String() string {
 		return ""
 	}
 
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
 	b := &bytes.Buffer{}
 	fmt.Fprintf(b, "Timeout %v\n", r.Timeout)
 	fmt.Fprintf(b, "TTL %v\n", r.TTL)
+	fmt.Fprintf(b, "MinTTL %v\n", r.MinTTL)
+	fmt.Fprintf(b, "CacheSize %d\n", r.CacheSize)
+	fmt.Fprintf(b, "Prefetch %v\n", r.Prefetch)
+	fmt.Fprintf(b, "Rotate %v\n", r.Rotate)
+	fmt.Fprintf(b, "Mode %s\n", r.Mode)
+	fmt.Fprintf(b, "Prefer %s\n", r.Prefer)
 	fmt.Fprintf(b, "Reload %v\n", r.period)
-	for i := range r.Servers {
-		fmt.Fprintln(b, r.Servers[i])
+	for _, ns := range r.Servers {
+		if len(ns.Domains) > 0 {
+			fmt.Fprintln(b, ns, strings.Join(ns.Domains, ","))
+			continue
+		}
+		fmt.Fprintln(b, ns)
 	}
 	return b.String()
 }
+
+// dohConn is a DNS-over-HTTPS (RFC 8484) connection used by the name resolver,
+// the DNS messages written to it are in the TCP format (with the two bytes length prefix),
+// each message is sent as an HTTP request, and the response is buffered for reading.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	method string
+	wbuf   bytes.Buffer
+	rbuf   bytes.Buffer
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		data := c.wbuf.Bytes()
+		n := int(data[0])<<8 | int(data[1])
+		if len(data) < 2+n {
+			break
+		}
+		reply, err := c.exchange(data[2 : 2+n])
+		if err != nil {
+			return 0, err
+		}
+		c.wbuf.Next(2 + n)
+
+		c.rbuf.Write([]byte{byte(len(reply) >> 8), byte(len(reply))})
+		c.rbuf.Write(reply)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if c.method == http.MethodGet {
+		u := c.url
+		if strings.Contains(u, "?") {
+			u += "&"
+		} else {
+			u += "?"
+		}
+		u += "dns=" + base64.RawURLEncoding.EncodeToString(msg)
+		req, err = http.NewRequest(http.MethodGet, u, nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, c.url, bytes.NewReader(msg))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", c.url, resp.Status)
+	}
+	reply, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 || len(reply) > 65535 {
+		return nil, fmt.Errorf("%s: invalid message size %d", c.url, len(reply))
+	}
+	return reply, nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,623 @@
+package gost
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestReply replies the A query with the ip, and the other queries with no answer.
+func dnsTestReply(query []byte, ip net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	n := 12
+	for n < len(query) && query[n] != 0 {
+		n += int(query[n]) + 1
+	}
+	n += 5 // the root label, type and class
+	if n > len(query) {
+		return nil
+	}
+	qtype := int(query[n-4])<<8 | int(query[n-3])
+
+	reply := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, query[12:n]...)
+	if qtype == 1 {
+		reply[7] = 1
+		reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		reply = append(reply, ip.To4()...)
+	}
+	return reply
+}
+
+func dohTestServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(r.Body)
+		}
+		reply := dnsTestReply(query, net.IPv4(1, 2, 3, 4))
+		if err != nil || reply == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(reply)
+	}))
+}
+
+func TestResolverDoH(t *testing.T) {
+	srv := dohTestServer()
+	defer srv.Close()
+
+	cert := srv.TLS.Certificates[0]
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	var tests = []struct {
+		ns NameServer
+		ok bool
+	}{
+		{NameServer{Addr: srv.URL, Protocol: "https", CAs: roots}, true},
+		{NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Method: "GET"}, true},
+		{NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Pins: []string{pin}}, true},
+		{NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Pins: []string{"sha256/AAAA"}}, false},
+		{NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Hostname: "dns.example.org"}, false},
+		{NameServer{Addr: srv.URL, Protocol: "https"}, false},
+	}
+
+	for i, test := range tests {
+		r := NewResolver(5*time.Second, -1, test.ns)
+		ips, _ := r.Resolve("gost.example.com")
+		ok := len(ips) == 1 && ips[0].Equal(net.IPv4(1, 2, 3, 4))
+		if ok != test.ok {
+			t.Errorf("#%d %s: got %v, should succeed: %v", i, test.ns, ips, test.ok)
+		}
+	}
+
+	// the name servers of the same URL with different verification settings do not share the HTTP client.
+	r := NewResolver(5*time.Second, -1,
+		NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Pins: []string{"sha256/AAAA"}},
+		NameServer{Addr: srv.URL, Protocol: "https", CAs: roots, Pins: []string{pin}},
+	)
+	if ips, _ := r.Resolve("gost.example.com"); len(ips) != 1 {
+		t.Errorf("got %v, the pinned name server should succeed", ips)
+	}
+}
+
+func TestParseNameServer(t *testing.T) {
+	var tests = []struct {
+		fields []string
+		ns     NameServer
+		err    bool
+	}{
+		{[]string{"1.1.1.1"}, NameServer{Addr: "1.1.1.1"}, false},
+		{[]string{"1.1.1.1:853", "tls", "cloudflare-dns.com"}, NameServer{Addr: "1.1.1.1:853", Protocol: "tls", Hostname: "cloudflare-dns.com"}, false},
+		{[]string{"https://1.1.1.1/dns-query", "method=get"}, NameServer{Addr: "https://1.1.1.1/dns-query", Protocol: "https", Method: "GET"}, false},
+		{[]string{"1.1.1.1:853", "tls", "pin=sha256/abc=", "pin=sha256/def="}, NameServer{Addr: "1.1.1.1:853", Protocol: "tls", Pins: []string{"sha256/abc=", "sha256/def="}}, false},
+		{[]string{"1.1.1.1:853", "tls", "ca=/nonexistent/ca.pem"}, NameServer{}, true},
+		{[]string{"10.0.0.53", "tcp", "domain=corp.example.com", "domain=example.internal"}, NameServer{Addr: "10.0.0.53", Protocol: "tcp", Domains: []string{"corp.example.com", "example.internal"}}, false},
+		{[]string{"1.1.1.1", "foo=bar"}, NameServer{}, true},
+		{[]string{"method=post"}, NameServer{}, true},
+	}
+
+	for i, test := range tests {
+		ns, err := ParseNameServer(test.fields...)
+		if test.err {
+			if err == nil {
+				t.Errorf("#%d: should return error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if ns.String() != test.ns.String() || ns.Method != test.ns.Method || len(ns.Pins) != len(test.ns.Pins) || len(ns.Domains) != len(test.ns.Domains) {
+			t.Errorf("#%d: got %+v, want %+v", i, ns, test.ns)
+		}
+	}
+
+	ns := NameServer{Addr: "dns.example.com", Protocol: "https"}
+	if ns.url() != "https://dns.example.com/dns-query" {
+		t.Errorf("wrong url %s", ns.url())
+	}
+	if cfg := ns.tlsConfig(); cfg.ServerName != "dns.example.com" || cfg.InsecureSkipVerify {
+		t.Errorf("wrong TLS config %+v", cfg)
+	}
+	ns = NameServer{Addr: "[2606:4700::1111]:853", Protocol: "tls"}
+	if cfg := ns.tlsConfig(); cfg.ServerName != "2606:4700::1111" {
+		t.Errorf("wrong server name %s", cfg.ServerName)
+	}
+}
+
+type countListener struct {
+	Listener
+	count int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.count, 1)
+	}
+	return conn, err
+}
+
+func TestResolverChain(t *testing.T) {
+	// the upstream name server answers by the hosts on both UDP and TCP.
+	dnsLn, err := DNSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsLn.Close()
+	go (&Server{Listener: dnsLn}).Serve(DNSHandler(
+		HostsHandlerOption(NewHosts(Host{IP: net.ParseIP("10.1.1.1"), Hostname: "www.example.com"})),
+	))
+	dnsAddr := dnsLn.Addr().String()
+
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := TLSConfigHandlerOption(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	var tests = []struct {
+		protocol  string
+		connector Connector
+		handler   Handler
+		ns        NameServer
+	}{
+		{"socks5", SOCKS5Connector(nil), SOCKS5Handler(tlsConfig), NameServer{Addr: dnsAddr}},
+		{"socks5", SOCKS5Connector(nil), SOCKS5Handler(tlsConfig), NameServer{Addr: dnsAddr, Protocol: "tcp"}},
+		{"http", HTTPConnector(nil), HTTPHandler(), NameServer{Addr: dnsAddr}}, // fall back to TCP
+		{"http", HTTPConnector(nil), HTTPHandler(), NameServer{Addr: dnsAddr, Protocol: "tcp"}},
+	}
+
+	for i, test := range tests {
+		tcpLn, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := &countListener{Listener: tcpLn}
+		go (&Server{Listener: ln}).Serve(test.handler)
+
+		chain := NewChain(Node{
+			Addr:     ln.Addr().String(),
+			Protocol: test.protocol,
+			Client: &Client{
+				Connector:   test.connector,
+				Transporter: TCPTransporter(),
+			},
+		})
+
+		r := NewChainResolver(chain, 3*time.Second, -1, test.ns)
+		ips, err := r.Resolve("www.example.com")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.1.1.1")) {
+			t.Errorf("#%d %s: got %v, %v", i, test.ns, ips, err)
+		}
+		if atomic.LoadInt32(&ln.count) == 0 {
+			t.Errorf("#%d %s: the queries should be sent through the chain", i, test.ns)
+		}
+		ln.Close()
+	}
+}
+
+func TestResolverChainUDP(t *testing.T) {
+	dnsLn, err := DNSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsLn.Close()
+	go (&Server{Listener: dnsLn}).Serve(DNSHandler(
+		HostsHandlerOption(NewHosts(Host{IP: net.ParseIP("10.1.1.1"), Hostname: "www.example.com"})),
+	))
+	dnsAddr := dnsLn.Addr().String()
+
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// the plain SOCKS5 node uses the standard UDP ASSOCIATE,
+	// and the SOCKS5 node over TLS uses the gost UDP tunnel.
+	tcpLn, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	go (&Server{Listener: tcpLn}).Serve(SOCKS5Handler(TLSConfigHandlerOption(tlsConfig)))
+
+	tlsLn, err := TLSListener("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsLn.Close()
+	go (&Server{Listener: tlsLn}).Serve(SOCKS5Handler(TLSConfigHandlerOption(tlsConfig)))
+
+	var tests = []struct {
+		node Node
+		udp  bool
+	}{
+		{Node{Addr: tcpLn.Addr().String(), Protocol: "socks5", Transport: "tcp",
+			Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TCPTransporter()}}, true},
+		{Node{Addr: tlsLn.Addr().String(), Protocol: "socks5", Transport: "tls",
+			Client: &Client{Connector: SOCKS5Connector(nil), Transporter: TLSTransporter()}}, false},
+	}
+
+	for i, test := range tests {
+		r := NewChainResolver(NewChain(test.node), 3*time.Second, -1, NameServer{Addr: dnsAddr}).(*resolver)
+		conn, err := r.dialUDP(context.Background(), dnsAddr)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		switch conn.(type) {
+		case *socks5UDPRemoteConn:
+			if !test.udp {
+				t.Errorf("#%d: the gost UDP tunnel should be used", i)
+			}
+		case *udpTunnelConn:
+			if test.udp {
+				t.Errorf("#%d: the standard UDP ASSOCIATE should be used", i)
+			}
+		default:
+			t.Errorf("#%d: unexpected conn %T", i, conn)
+		}
+		conn.Close()
+
+		ips, err := r.Resolve("www.example.com")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.1.1.1")) {
+			t.Errorf("#%d: got %v, %v", i, ips, err)
+		}
+	}
+}
+
+// dnsTestZoneReply replies the A query of a.example.com with two addresses for 300 seconds,
+// the other queries of a.example.com with no answer, b.example.com with an IPv4 and an IPv6 address,
+// and the other names with NXDOMAIN,
+// the SOA of the negative replies has the MINIMUM 5 seconds.
+func dnsTestZoneReply(query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: hdr.ID, Response: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	soa := &dnsmessage.SOAResource{
+		ResourceHeader: dnsmessage.ResourceHeader{Name: "example.com.", Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+		NS:             "ns.example.com.",
+		MBox:           "admin.example.com.",
+		MinTTL:         5,
+	}
+	switch {
+	case q.Name == "a.example.com." && q.Type == dnsmessage.TypeA:
+		for _, ip := range [][4]byte{{1, 1, 1, 1}, {1, 1, 1, 2}} {
+			m.Answers = append(m.Answers, &dnsmessage.AResource{
+				ResourceHeader: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				A:              ip,
+			})
+		}
+	case q.Name == "a.example.com.":
+		m.Authorities = []dnsmessage.Resource{soa}
+	case q.Name == "b.example.com." && q.Type == dnsmessage.TypeA:
+		m.Answers = []dnsmessage.Resource{&dnsmessage.AResource{
+			ResourceHeader: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			A:              [4]byte{2, 2, 2, 2},
+		}}
+	case q.Name == "b.example.com." && q.Type == dnsmessage.TypeAAAA:
+		m.Answers = []dnsmessage.Resource{&dnsmessage.AAAAResource{
+			ResourceHeader: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 300},
+			AAAA:           [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1},
+		}}
+	case q.Name == "b.example.com.":
+		m.Authorities = []dnsmessage.Resource{soa}
+	default:
+		m.RCode = dnsmessage.RCodeNameError
+		m.Authorities = []dnsmessage.Resource{soa}
+	}
+	reply, _ := m.Pack()
+	return reply
+}
+
+// dnsTestZoneServer starts a UDP name server which replies by dnsTestZoneReply after the delay.
+func dnsTestZoneServer(t *testing.T, delay time.Duration, count *int32) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			b := make([]byte, 1500)
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(count, 1)
+			go func() {
+				time.Sleep(delay)
+				pc.WriteTo(dnsTestZoneReply(b[:n]), addr)
+			}()
+		}
+	}()
+	return pc
+}
+
+func TestResolverCache(t *testing.T) {
+	var count int32
+	pc := dnsTestZoneServer(t, 0, &count)
+	defer pc.Close()
+
+	r := NewResolver(3*time.Second, 0).(*resolver)
+	err := r.Reload(bytes.NewReader([]byte(strings.Join([]string{
+		"ttl 120s",
+		"minttl 10s",
+		"cachesize 3",
+		"rotate true",
+		pc.LocalAddr().String(),
+	}, "\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips1, err := r.Resolve("a.example.com")
+	if err != nil || len(ips1) != 2 {
+		t.Fatalf("got %v, %v", ips1, err)
+	}
+	ips2, err := r.Resolve("a.example.com")
+	if err != nil || len(ips2) != 2 || ips1[0].Equal(ips2[0]) {
+		t.Errorf("the addresses should be rotated, got %v, %v", ips1, ips2)
+	}
+	if n := atomic.LoadInt32(&count); n != 2 {
+		t.Errorf("upstream should be queried twice (A and AAAA), got %d", n)
+	}
+
+	ttl := func(key string) time.Duration {
+		e := r.cache.items[key]
+		if e == nil {
+			return 0
+		}
+		return e.Value.(*dnsCacheItem).ttl
+	}
+	if v := ttl("a.example.com./1/1"); v != 120*time.Second {
+		t.Errorf("ttl should be clamped to the max 120s, got %v", v)
+	}
+	if v := ttl("a.example.com./28/1"); v != 10*time.Second {
+		t.Errorf("negative ttl should be clamped to the min 10s, got %v", v)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Resolve("nx.example.com"); err == nil {
+			t.Error("NXDOMAIN should return error")
+		}
+	}
+	if n := atomic.LoadInt32(&count); n != 4 {
+		t.Errorf("NXDOMAIN should be cached, upstream is queried %d times", n)
+	}
+	if n := r.cache.len(); n != 3 {
+		t.Errorf("cache should be bounded to 3, got %d", n)
+	}
+
+	// prefetch the reply in the last tenth of the TTL.
+	r.Prefetch = true
+	e := r.cache.items["nx.example.com./1/1"]
+	e.Value.(*dnsCacheItem).ts = time.Now().Add(-9500 * time.Millisecond)
+	r.Resolve("nx.example.com")
+	for i := 0; i < 100 && atomic.LoadInt32(&count) == 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&count); n != 5 {
+		t.Errorf("the reply should be prefetched, upstream is queried %d times", n)
+	}
+}
+
+func TestResolverCacheKey(t *testing.T) {
+	var count int32
+	pc := dnsTestZoneServer(t, 0, &count)
+	defer pc.Close()
+
+	r := NewResolver(3*time.Second, 0, NameServer{Addr: pc.LocalAddr().String()}).(*resolver)
+
+	q := dnsmessage.Question{Name: "b.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	plain := dnsTestQueryMessage(q.Name, q.Type)
+	// opt appends the EDNS0 OPT record with the UDP payload size 4096 and the flags.
+	opt := func(flags uint16) []byte {
+		b := append([]byte(nil), plain...)
+		b[11]++
+		return append(b, 0, 0, dnsTypeOPT, 0x10, 0, 0, 0, byte(flags>>8), byte(flags), 0, 0)
+	}
+	cd := append([]byte(nil), plain...)
+	cd[3] |= 0x10
+
+	var tests = []struct {
+		query []byte
+		key   string
+	}{
+		{plain, "b.example.com./1/1"},
+		{cd, "b.example.com./1/1/cd"},
+		{opt(0), "b.example.com./1/1/opt"},
+		{opt(0x8000), "b.example.com./1/1/opt/do"},
+	}
+	for i, test := range tests {
+		if key := dnsCacheKey(test.query, q); key != test.key {
+			t.Errorf("#%d: key should be %s, got %s", i, test.key, key)
+		}
+		// the replies of the different keys are cached separately.
+		for j := 0; j < 2; j++ {
+			if _, err := r.Exchange(context.Background(), test.query); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		if n := atomic.LoadInt32(&count); n != int32(i+1) {
+			t.Errorf("#%d: upstream should be queried %d times, got %d", i, i+1, n)
+		}
+	}
+}
+
+func TestResolverMode(t *testing.T) {
+	var slowCount, fastCount int32
+	slow := dnsTestZoneServer(t, time.Second, &slowCount)
+	defer slow.Close()
+	fast := dnsTestZoneServer(t, 0, &fastCount)
+	defer fast.Close()
+
+	servers := []NameServer{{Addr: slow.LocalAddr().String()}, {Addr: fast.LocalAddr().String()}}
+
+	r := NewResolver(time.Second, -1, servers...).(*resolver)
+	r.Mode = ResolverModeParallel
+	start := time.Now()
+	if ips, err := r.Resolve("b.example.com"); err != nil || len(ips) != 2 {
+		t.Errorf("parallel: got %v, %v", ips, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("parallel: the fast name server should win, took %v", d)
+	}
+
+	r = NewResolver(100*time.Millisecond, -1, servers...).(*resolver)
+	if _, err := r.Resolve("b.example.com"); err == nil {
+		t.Error("sequential: the slow name server should time out")
+	}
+
+	r = NewResolver(time.Second, -1, servers...).(*resolver)
+	r.Mode = ResolverModeRoundRobin
+	r.Prefer = ResolverIPv4Only
+	atomic.StoreInt32(&slowCount, 0)
+	atomic.StoreInt32(&fastCount, 0)
+	for i := 0; i < 2; i++ {
+		r.exchangeServers(context.Background(), "b.example.com.", dnsTestQueryMessage("b.example.com.", dnsmessage.TypeA))
+	}
+	if atomic.LoadInt32(&slowCount) != 1 || atomic.LoadInt32(&fastCount) != 1 {
+		t.Errorf("round-robin: the name servers should be queried in turn, got %d, %d", slowCount, fastCount)
+	}
+
+	var tests = []struct {
+		prefer string
+		ips    []string
+	}{
+		{"", []string{"2.2.2.2", "2001:db8::1"}},
+		{ResolverPreferIPv4, []string{"2.2.2.2", "2001:db8::1"}},
+		{ResolverPreferIPv6, []string{"2001:db8::1", "2.2.2.2"}},
+		{ResolverIPv4Only, []string{"2.2.2.2"}},
+		{ResolverIPv6Only, []string{"2001:db8::1"}},
+	}
+	for _, test := range tests {
+		r := NewResolver(time.Second, -1, servers[1]).(*resolver)
+		r.Prefer = test.prefer
+		ips, err := r.Resolve("b.example.com")
+		if err != nil || len(ips) != len(test.ips) {
+			t.Errorf("%s: got %v, %v", test.prefer, ips, err)
+			continue
+		}
+		for i := range ips {
+			if !ips[i].Equal(net.ParseIP(test.ips[i])) {
+				t.Errorf("%s: got %v, want %v", test.prefer, ips, test.ips)
+				break
+			}
+		}
+	}
+}
+
+func TestResolverSplitHorizon(t *testing.T) {
+	var defaultCount, corpCount, devCount int32
+	defaultNS := dnsTestZoneServer(t, 0, &defaultCount)
+	defer defaultNS.Close()
+	corpNS := dnsTestZoneServer(t, 0, &corpCount)
+	defer corpNS.Close()
+	devNS := dnsTestZoneServer(t, 0, &devCount)
+	defer devNS.Close()
+
+	r := NewResolver(time.Second, -1).(*resolver)
+	err := r.Reload(bytes.NewReader([]byte(strings.Join([]string{
+		defaultNS.LocalAddr().String(),
+		"[example.com, example.net]",
+		corpNS.LocalAddr().String(),
+		"[default]",
+		defaultNS.LocalAddr().String() + " tcp",
+		devNS.LocalAddr().String() + " domain=dev.example.com",
+	}, "\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Servers) != 4 || len(r.Servers[0].Domains) != 0 || len(r.Servers[1].Domains) != 2 || len(r.Servers[2].Domains) != 0 {
+		t.Fatalf("wrong name servers %v", r.Servers)
+	}
+
+	var tests = []struct {
+		name  string
+		count *int32
+	}{
+		{"b.example.com", &corpCount},
+		{"example.net", &corpCount},
+		{"b.dev.example.com", &devCount},
+		{"b.example.org", &defaultCount},
+		{"b.notexample.com", &defaultCount},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&defaultCount, 0)
+		atomic.StoreInt32(&corpCount, 0)
+		atomic.StoreInt32(&devCount, 0)
+		r.Resolve(test.name)
+		if atomic.LoadInt32(test.count) == 0 || atomic.LoadInt32(&defaultCount)+atomic.LoadInt32(&corpCount)+atomic.LoadInt32(&devCount) != atomic.LoadInt32(test.count) {
+			t.Errorf("%s: queried by the wrong name servers: default %d, corp %d, dev %d", test.name, defaultCount, corpCount, devCount)
+		}
+	}
+}
+
+func TestResolverReloadConcurrent(t *testing.T) {
+	var count int32
+	ns := dnsTestZoneServer(t, 0, &count)
+	defer ns.Close()
+
+	r := NewResolver(time.Second, -1, NameServer{Addr: ns.LocalAddr().String()}).(*resolver)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			r.Reload(bytes.NewReader([]byte(strings.Join([]string{
+				"timeout 1s", "mode parallel", "prefer ipv4-only",
+				ns.LocalAddr().String(),
+			}, "\n"))))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := r.Resolve("b.example.com"); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,228 @@
+package gost
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReverseRule maps the requests of the virtual host and path prefix to the backend.
+type ReverseRule struct {
+	// Host is the virtual host, it can be a wildcard in the form of *.domain,
+	// or * for all the hosts.
+	Host string
+	// Path is the path prefix, it is matched on the boundary of the path segments, the default is /.
+	Path string
+	// Backend is the URL of the backend, the path prefix is replaced by the path of the backend.
+	Backend *url.URL
+	// Insecure disables the verification of the certificate of the https backend.
+	Insecure bool
+}
+
+// ReverseProxy is the table of the reverse proxy rules of the HTTP handler.
+// The requests in origin form (the non-proxy requests) are matched by the Host header and the path,
+// then sent to the backend through the chain.
+// For each rule a single line should be present with the following information:
+// host[/path] backend_URL [insecure]
+// The rule of the exact host is matched first, then the wildcards from the longest domain, then the * host.
+// In the rules of the host, the longest path prefix is matched.
+// Text from a "#" character until the end of the line is a comment, and is ignored.
+type ReverseProxy struct {
+	rules  map[string][]ReverseRule // the rules of the hosts, sorted by the length of the path in descending order
+	period time.Duration
+	mux    sync.RWMutex
+}
+
+// NewReverseProxy creates a ReverseProxy with optional list of rules.
+func NewReverseProxy(rules ...ReverseRule) *ReverseProxy {
+	p := &ReverseProxy{}
+	p.setRules(rules)
+	return p
+}
+
+func (p *ReverseProxy) setRules(rules []ReverseRule) {
+	m := make(map[string][]ReverseRule)
+	for _, rule := range rules {
+		if rule.Backend == nil {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSuffix(rule.Host, "."))
+		if host == "" {
+			host = "*"
+		}
+		rule.Path = "/" + strings.Trim(rule.Path, "/")
+		m[host] = append(m[host], rule)
+	}
+	for _, v := range m {
+		sort.SliceStable(v, func(i, j int) bool {
+			return len(v[i].Path) > len(v[j].Path)
+		})
+	}
+
+	p.mux.Lock()
+	p.rules = m
+	p.mux.Unlock()
+}
+
+// Match finds the rule for the host and path of the request, or returns nil if no rule is matched.
+// The path is in the escaped form, such as the URL.EscapedPath, it is cleaned like path.Clean before it is matched,
+// including the escaped dot segments such as %2e%2e, so it can not leave the path prefix of the rule.
+// The Backend of the returned rule is the URL for the path, the escaped form of the path is preserved.
+func (p *ReverseProxy) Match(host, path string) *ReverseRule {
+	if p == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if path == "" {
+		path = "/"
+	}
+
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	names := []string{host}
+	for name := host; ; {
+		n := strings.IndexByte(name, '.')
+		if n < 0 {
+			break
+		}
+		name = name[n+1:]
+		names = append(names, "*."+name)
+	}
+	names = append(names, "*")
+
+	for _, name := range names {
+		for _, rule := range p.rules[name] {
+			if u := rule.rewrite(path); u != nil {
+				rule.Backend = u
+				return &rule
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the path prefix of the rule by the path of the backend,
+// it returns nil if the path does not match the prefix or it is invalid.
+func (rule *ReverseRule) rewrite(path string) *url.URL {
+	raws, segs, ok := splitEscapedPath(path)
+	if !ok {
+		return nil
+	}
+	if rule.Path != "/" {
+		prefix := strings.Split(strings.TrimPrefix(rule.Path, "/"), "/")
+		if len(segs) < len(prefix) {
+			return nil
+		}
+		for i := range prefix {
+			if segs[i] != prefix[i] {
+				return nil
+			}
+		}
+		raws, segs = raws[len(prefix):], segs[len(prefix):]
+	}
+
+	u := *rule.Backend
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.Join(segs, "/")
+	// the RawPath is only used if it is a valid encoding of the Path, such as the escaped slashes %2F.
+	u.RawPath = strings.TrimSuffix(rule.Backend.EscapedPath(), "/") + "/" + strings.Join(raws, "/")
+	return &u
+}
+
+// splitEscapedPath splits the escaped path into the escaped segments and the unescaped segments,
+// the empty and dot segments are removed like path.Clean, the dot segments are compared after unescaping,
+// and the trailing slash is kept as an empty last segment.
+// ok is false if the path has invalid escapes, or a segment has the escaped slashes around a dot segment, such as ..%2F.
+func splitEscapedPath(path string) (raws, segs []string, ok bool) {
+	parts := strings.Split(path, "/")
+	for _, raw := range parts {
+		seg, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, nil, false
+		}
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(segs) > 0 {
+				raws, segs = raws[:len(raws)-1], segs[:len(segs)-1]
+			}
+		default:
+			if strings.Contains(seg, "/") {
+				for _, s := range strings.Split(seg, "/") {
+					if s == "." || s == ".." {
+						return nil, nil, false
+					}
+				}
+			}
+			raws, segs = append(raws, raw), append(segs, seg)
+		}
+	}
+	if len(segs) > 0 && parts[len(parts)-1] == "" {
+		raws, segs = append(raws, ""), append(segs, "")
+	}
+	return raws, segs, true
+}
+
+// Reload parses config from r, then live reloads the rules.
+func (p *ReverseProxy) Reload(r io.Reader) error {
+	var rules []ReverseRule
+	var period time.Duration
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if n := strings.IndexByte(line, '#'); n >= 0 {
+			line = line[:n]
+		}
+		ss := strings.Fields(line)
+		if len(ss) < 2 {
+			continue // invalid lines are ignored
+		}
+
+		// reload option
+		if strings.ToLower(ss[0]) == "reload" {
+			period, _ = time.ParseDuration(ss[1])
+			continue
+		}
+
+		backend, err := url.Parse(ss[1])
+		if err != nil || (backend.Scheme != "http" && backend.Scheme != "https") || backend.Host == "" {
+			continue // invalid backends are ignored
+		}
+		rule := ReverseRule{
+			Host:     ss[0],
+			Backend:  backend,
+			Insecure: len(ss) > 2 && strings.ToLower(ss[2]) == "insecure",
+		}
+		if n := strings.IndexByte(ss[0], '/'); n >= 0 {
+			rule.Host = ss[0][:n]
+			rule.Path = ss[0][n:]
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.setRules(rules)
+	p.mux.Lock()
+	p.period = period
+	p.mux.Unlock()
+	return nil
+}
+
+// Period returns the reload period
+func (p *ReverseProxy) Period() time.Duration {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.period
+}
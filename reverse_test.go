@@ -0,0 +1,226 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var reverseProxyTests = []struct {
+	host    string
+	path    string
+	backend string
+}{
+	{"example.com", "/", "http://10.0.0.1/"},
+	{"example.com:8080", "/index.html", "http://10.0.0.1/index.html"},
+	{"EXAMPLE.COM", "/api", "http://10.0.0.2:8080/v1/"},
+	{"example.com", "/api/users", "http://10.0.0.2:8080/v1/users"},
+	{"example.com", "/apix", "http://10.0.0.1/apix"},
+	{"example.com", "/api/admin/x", "https://10.0.0.3/x"},
+	{"www.example.com", "/", "http://10.0.0.4/www/"},
+	{"a.b.example.com", "/api/users", "http://10.0.0.5/users"},
+	{"a.b.example.com", "/", "http://10.0.0.4/www/"},
+	{"example.org", "/", "http://10.0.0.6/"},
+	{"example.com", "/api/v2/../users/", "http://10.0.0.2:8080/v1/users/"},
+	{"example.com", "/api//users/.", "http://10.0.0.2:8080/v1/users"},
+	{"example.com", "/api/../admin", "http://10.0.0.1/admin"},
+	{"example.com", "/api/%2e%2e/admin", "http://10.0.0.1/admin"},
+	{"example.com", "/x/../../api/admin/x", "https://10.0.0.3/x"},
+	{"example.com", "/api/a%2Fb", "http://10.0.0.2:8080/v1/a%2Fb"},
+}
+
+func TestReverseProxyMatch(t *testing.T) {
+	p := NewReverseProxy()
+	err := p.Reload(bytes.NewBufferString(`
+reload 10s
+example.com           http://10.0.0.1
+example.com/api       http://10.0.0.2:8080/v1/
+example.com/api/admin https://10.0.0.3 insecure # the longest prefix
+*.example.com         http://10.0.0.4/www
+*.example.com/api     http://10.0.0.5
+*                     http://10.0.0.6
+invalid.com           ftp://10.0.0.7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Period() != 10e9 {
+		t.Errorf("got period %v, want 10s", p.Period())
+	}
+
+	for _, test := range reverseProxyTests {
+		rule := p.Match(test.host, test.path)
+		if rule == nil {
+			t.Errorf("%s%s: no rule", test.host, test.path)
+			continue
+		}
+		if rule.Backend.String() != test.backend {
+			t.Errorf("%s%s: got %s, want %s", test.host, test.path, rule.Backend, test.backend)
+		}
+		if rule.Insecure != (rule.Backend.Scheme == "https") {
+			t.Errorf("%s%s: got insecure %v", test.host, test.path, rule.Insecure)
+		}
+	}
+
+	for _, path := range []string{"/api/..%2F..%2Fetc", "/api/%zz"} {
+		if rule := p.Match("example.com", path); rule != nil {
+			t.Errorf("%s: got %v, want no rule", path, rule.Backend)
+		}
+	}
+
+	if rule := NewReverseProxy().Match("example.com", "/"); rule != nil {
+		t.Errorf("got %v, want no rule", rule.Backend)
+	}
+	if rule := (*ReverseProxy)(nil).Match("example.com", "/"); rule != nil {
+		t.Errorf("got %v, want no rule", rule.Backend)
+	}
+}
+
+func TestHTTPReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw)
+			return
+		}
+		io.WriteString(w, strings.Join([]string{
+			r.Host, r.URL.String(),
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"),
+		}, " "))
+	}))
+	defer backend.Close()
+
+	p := NewReverseProxy()
+	p.Reload(bytes.NewBufferString("www.example.com/app " + backend.URL + "/v1"))
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler(ReverseProxyHandlerOption(p)))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	roundtrip := func(host, path string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, ""
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	clientIP := addrIP(conn.LocalAddr())
+	want := backendHost + " /v1/index.html?q=1 " + clientIP.String() + " www.example.com http"
+	if _, body := roundtrip("www.example.com", "/app/index.html?q=1",
+		http.Header{"X-Forwarded-For": []string{"1.2.3.4"}}); body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	if resp, _ := roundtrip("example.com", "/app", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", resp.StatusCode)
+	}
+	// the path can not leave the prefix of the rule.
+	for _, path := range []string{"/app/../secret", "/app/%2e%2e/secret"} {
+		if resp, _ := roundtrip("www.example.com", path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, resp.StatusCode)
+		}
+	}
+	// the escaped slash is preserved.
+	if _, body := roundtrip("www.example.com", "/app/a%2Fb", nil); !strings.HasPrefix(body, backendHost+" /v1/a%2Fb ") {
+		t.Errorf("got %q, want the path /v1/a%%2Fb", body)
+	}
+
+	// the connection is tunneled after the upgrade
+	resp, _ := roundtrip("www.example.com", "/app/ws", http.Header{
+		"Upgrade":    []string{"echo"},
+		"Connection": []string{"Upgrade"},
+	})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q %v, want ping", b, err)
+	}
+}
+
+func TestHTTPReverseProxyVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := NewReverseProxy()
+	p.Reload(bytes.NewBufferString(strings.Join([]string{
+		"verify.example.com " + backend.URL,
+		"insecure.example.com " + backend.URL + " insecure",
+	}, "\n")))
+
+	ln, err := TCPListener("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler(ReverseProxyHandlerOption(p)))
+	defer server.Close()
+
+	var tests = []struct {
+		host   string
+		status int
+	}{
+		{"verify.example.com", http.StatusServiceUnavailable}, // the certificate of the backend is self-signed
+		{"insecure.example.com", http.StatusOK},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+test.host+"/", nil)
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.host, err)
+			continue
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.host, resp.StatusCode, test.status)
+		}
+	}
+}
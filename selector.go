@@ -81,7 +81,7 @@ func (s *RoundStrategy) Apply(nodes []Node) Node {
 	}
 	old := atomic.LoadUint64(&s.count)
 	atomic.AddUint64(&s.count, 1)
-	return nodes[int(old%uint64(len(nodes)))]
+	return nodes[int(old%uint64(len(nodes)))].Clone()
 }
 
 func (s *RoundStrategy) String() string {
@@ -109,7 +109,7 @@ func (s *RandomStrategy) Apply(nodes []Node) Node {
 		return Node{}
 	}
 
-	return nodes[s.rand.Int()%len(nodes)]
+	return nodes[s.rand.Int()%len(nodes)].Clone()
 }
 
 func (s *RandomStrategy) String() string {
@@ -126,7 +126,7 @@ func (s *FIFOStrategy) Apply(nodes []Node) Node {
 	if len(nodes) == 0 {
 		return Node{}
 	}
-	return nodes[0]
+	return nodes[0].Clone()
 }
 
 func (s *FIFOStrategy) String() string {
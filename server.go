@@ -144,18 +144,12 @@ var (
 func transport(rw1, rw2 io.ReadWriter) error {
 	errc := make(chan error, 1)
 	go func() {
-		buf := trPool.Get().([]byte)
-		defer trPool.Put(buf)
-
-		_, err := io.CopyBuffer(rw1, rw2, buf)
+		_, err := copyBuffer(rw1, rw2)
 		errc <- err
 	}()
 
 	go func() {
-		buf := trPool.Get().([]byte)
-		defer trPool.Put(buf)
-
-		_, err := io.CopyBuffer(rw2, rw1, buf)
+		_, err := copyBuffer(rw2, rw1)
 		errc <- err
 	}()
 
@@ -165,3 +159,36 @@ func transport(rw1, rw2 io.ReadWriter) error {
 	}
 	return err
 }
+
+// copyBuffer copies from src to dst until either EOF is reached on src or an error occurs.
+// If both of src and dst are plain TCP connections (after unwrapping),
+// the data is relayed by the kernel (splice on Linux) without passing through the user space.
+// It returns the number of bytes written to dst, including the data buffered by src.
+func copyBuffer(dst io.Writer, src io.Reader) (written int64, err error) {
+	if w, r := tcpConnOf(dst), tcpConnOf(src); w != nil && r != nil {
+		// flush the data already buffered by the wrapper before going zero-copy.
+		if bc, ok := src.(*bufferdConn); ok {
+			if written, err = bc.flush(dst); err != nil {
+				return
+			}
+		}
+		n, err := w.ReadFrom(r)
+		return written + n, err
+	}
+
+	buf := trPool.Get().([]byte)
+	defer trPool.Put(buf)
+
+	return io.CopyBuffer(dst, src, buf)
+}
+
+// tcpConnOf returns the underlying TCP connection of v if it is (or wraps) a *net.TCPConn.
+func tcpConnOf(v interface{}) *net.TCPConn {
+	switch c := v.(type) {
+	case *net.TCPConn:
+		return c
+	case *bufferdConn:
+		return tcpConnOf(c.Conn)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func tcpPair() (c1, c2 *net.TCPConn, err error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		var e error
+		c2, e = ln.AcceptTCP()
+		errc <- e
+	}()
+	if c1, err = net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr)); err != nil {
+		return
+	}
+	err = <-errc
+	return
+}
+
+func TestCopyBufferTCP(t *testing.T) {
+	src1, src2, err := tcpPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src1.Close()
+	defer src2.Close()
+	dst1, dst2, err := tcpPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst1.Close()
+	defer dst2.Close()
+
+	data := bytes.Repeat([]byte("gost"), 64*1024)
+	go func() {
+		src1.Write(data)
+		src1.Close()
+	}()
+
+	// peek some data so that the wrapper holds buffered bytes.
+	br := bufio.NewReader(src2)
+	if _, err := br.Peek(1); err != nil {
+		t.Fatal(err)
+	}
+	src := &bufferdConn{Conn: src2, br: br}
+	if tcpConnOf(src) != src2 {
+		t.Fatal("bufferdConn should be unwrapped to the TCP connection")
+	}
+
+	recv := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(dst2)
+		recv <- b
+	}()
+
+	n, err := copyBuffer(dst1, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst1.Close()
+
+	if n != int64(len(data)) {
+		t.Errorf("written %d bytes, want %d", n, len(data))
+	}
+	if b := <-recv; !bytes.Equal(b, data) {
+		t.Errorf("data mismatch, got %d bytes", len(b))
+	}
+}
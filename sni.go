@@ -90,11 +90,11 @@ func (h *sniHandler) Handle(conn net.Conn) {
 
 	addr := net.JoinHostPort(host, "443")
 
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", addr, conn.RemoteAddr(), "") {
 		log.Logf("[sni] Unauthorized to tcp connect to %s", addr)
 		return
 	}
-	if h.options.Bypass.Contains(addr) {
+	if h.options.bypass(addr) {
 		log.Log("[sni] [bypass]", addr)
 		return
 	}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ginuerzh/gosocks4"
@@ -95,9 +96,11 @@ func (selector *clientSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 }
 
 type serverSelector struct {
-	methods   []uint8
-	Users     []*url.Userinfo
-	TLSConfig *tls.Config
+	methods       []uint8
+	Authenticator Authenticator
+	AuthGuard     *AuthGuard
+	TLSConfig     *tls.Config
+	user          string // the authenticated user of the connection
 }
 
 func (selector *serverSelector) Methods() []uint8 {
@@ -120,8 +123,9 @@ func (selector *serverSelector) Select(methods ...uint8) (method uint8) {
 		}
 	}
 
-	// when user/pass is set, auth is mandatory
-	if len(selector.Users) > 0 {
+	// when user/pass is set, auth is mandatory,
+	// unless the client has been authenticated by the TLS client certificate.
+	if selector.Authenticator != nil && selector.user == "" {
 		if method == gosocks5.MethodNoAuth {
 			method = gosocks5.MethodUserPass
 		}
@@ -154,18 +158,14 @@ func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 		if Debug {
 			log.Log("[socks5]", req.String())
 		}
-		valid := false
-		for _, user := range selector.Users {
-			username := user.Username()
-			password, _ := user.Password()
-			if (req.Username == username && req.Password == password) ||
-				(req.Username == username && password == "") ||
-				(username == "" && req.Password == password) {
-				valid = true
-				break
-			}
+		ip := addrIP(conn.RemoteAddr())
+		if selector.AuthGuard.Banned(ip) {
+			log.Logf("[socks5] %s : banned", conn.RemoteAddr())
+			return nil, gosocks5.ErrAuthFailure
 		}
-		if len(selector.Users) > 0 && !valid {
+		id, ok := authenticate(selector.Authenticator, req.Username, req.Password)
+		if !ok {
+			selector.AuthGuard.Fail(ip, req.Username)
 			resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure)
 			if err := resp.Write(conn); err != nil {
 				log.Log("[socks5]", err)
@@ -186,6 +186,8 @@ func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 		if Debug {
 			log.Log("[socks5]", resp)
 		}
+		selector.AuthGuard.Succeed(ip)
+		selector.user = id
 	case gosocks5.MethodNoAcceptable:
 		return nil, gosocks5.ErrBadMethod
 	}
@@ -362,14 +364,16 @@ func (h *socks5Handler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
 
 	tlsConfig := h.options.TLSConfig
 	if tlsConfig == nil {
 		tlsConfig = DefaultTLSConfig
 	}
 	h.selector = &serverSelector{ // socks5 server selector
-		Users:     h.options.Users,
-		TLSConfig: tlsConfig,
+		Authenticator: h.options.Authenticator,
+		AuthGuard:     h.options.AuthGuard,
+		TLSConfig:     tlsConfig,
 	}
 	// methods that socks5 server supported
 	h.selector.AddMethod(
@@ -383,7 +387,15 @@ func (h *socks5Handler) Init(options ...HandlerOption) {
 func (h *socks5Handler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	conn = gosocks5.ServerConn(conn, h.selector)
+	// the selector holds the authenticated user, so each connection has its own copy.
+	selector := &serverSelector{
+		methods:       h.selector.methods,
+		Authenticator: h.selector.Authenticator,
+		AuthGuard:     h.selector.AuthGuard,
+		TLSConfig:     h.selector.TLSConfig,
+		user:          tlsClientUser(conn),
+	}
+	conn = gosocks5.ServerConn(conn, selector)
 	req, err := gosocks5.ReadRequest(conn)
 	if err != nil {
 		log.Log("[socks5]", err)
@@ -391,32 +403,36 @@ func (h *socks5Handler) Handle(conn net.Conn) {
 	}
 
 	if Debug {
-		log.Logf("[socks5] %s - %s\n%s", conn.RemoteAddr(), req.Addr, req)
+		var su string
+		if selector.user != "" {
+			su = selector.user + "@"
+		}
+		log.Logf("[socks5] %s%s - %s\n%s", su, conn.RemoteAddr(), req.Addr, req)
 	}
 	switch req.Cmd {
 	case gosocks5.CmdConnect:
-		h.handleConnect(conn, req)
+		h.handleConnect(conn, req, selector.user)
 
 	case gosocks5.CmdBind:
-		h.handleBind(conn, req)
+		h.handleBind(conn, req, selector.user)
 
 	case gosocks5.CmdUdp:
-		h.handleUDPRelay(conn, req)
+		h.handleUDPRelay(conn, req, selector.user)
 
 	case CmdMuxBind:
-		h.handleMuxBind(conn, req)
+		h.handleMuxBind(conn, req, selector.user)
 
 	case CmdUDPTun:
-		h.handleUDPTunnel(conn, req)
+		h.handleUDPTunnel(conn, req, selector.user)
 
 	default:
 		log.Log("[socks5] Unrecognized request:", req.Cmd)
 	}
 }
 
-func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
+func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request, user string) {
 	addr := req.Addr.String()
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", addr, conn.RemoteAddr(), user) {
 		log.Logf("[socks5-connect] Unauthorized to tcp connect to %s", addr)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
@@ -425,7 +441,7 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 		}
 		return
 	}
-	if h.options.Bypass.Contains(addr) {
+	if h.options.bypass(addr) {
 		log.Logf("[socks5-connect] [bypass] %s", addr)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
@@ -465,10 +481,10 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 	log.Logf("[socks5-connect] %s >-< %s", conn.RemoteAddr(), req.Addr)
 }
 
-func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request) {
+func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request, user string) {
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rtcp", addr, conn.RemoteAddr(), user) {
 			log.Logf("Unauthorized to tcp bind to %s", addr)
 			return
 		}
@@ -589,9 +605,9 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 	}
 }
 
-func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
+func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request, user string) {
 	addr := req.Addr.String()
-	if !Can("udp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("udp", addr, conn.RemoteAddr(), user) {
 		log.Logf("[socks5-udp] Unauthorized to udp connect to %s", addr)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
@@ -736,7 +752,7 @@ func (h *socks5Handler) transportUDP(relay, peer *net.UDPConn) (err error) {
 			if err != nil {
 				continue // drop silently
 			}
-			if h.options.Bypass.Contains(raddr.String()) {
+			if h.options.bypass(raddr.String()) {
 				log.Log("[socks5-udp] [bypass] write to", raddr)
 				continue // bypass
 			}
@@ -762,7 +778,7 @@ func (h *socks5Handler) transportUDP(relay, peer *net.UDPConn) (err error) {
 			if clientAddr == nil {
 				continue
 			}
-			if h.options.Bypass.Contains(raddr.String()) {
+			if h.options.bypass(raddr.String()) {
 				log.Log("[socks5-udp] [bypass] read from", raddr)
 				continue // bypass
 			}
@@ -814,7 +830,7 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 				clientAddr = addr
 			}
 			raddr := dgram.Header.Addr.String()
-			if h.options.Bypass.Contains(raddr) {
+			if h.options.bypass(raddr) {
 				log.Log("[udp-tun] [bypass] write to", raddr)
 				continue // bypass
 			}
@@ -843,7 +859,7 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 				continue
 			}
 			raddr := dgram.Header.Addr.String()
-			if h.options.Bypass.Contains(raddr) {
+			if h.options.bypass(raddr) {
 				log.Log("[udp-tun] [bypass] read from", raddr)
 				continue // bypass
 			}
@@ -868,12 +884,12 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 	return
 }
 
-func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
+func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request, user string) {
 	// serve tunnel udp, tunnel <-> remote, handle tunnel udp request
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
 
-		if !Can("rudp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rudp", addr, conn.RemoteAddr(), user) {
 			log.Logf("[socks5-udp] Unauthorized to udp bind to %s", addr)
 			return
 		}
@@ -941,7 +957,7 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, uc *net.UDPConn) (err error
 				errc <- err
 				return
 			}
-			if h.options.Bypass.Contains(addr.String()) {
+			if h.options.bypass(addr.String()) {
 				log.Log("[udp-tun] [bypass] read from", addr)
 				continue // bypass
 			}
@@ -974,7 +990,7 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, uc *net.UDPConn) (err error
 			if err != nil {
 				continue // drop silently
 			}
-			if h.options.Bypass.Contains(addr.String()) {
+			if h.options.bypass(addr.String()) {
 				log.Log("[udp-tun] [bypass] write to", addr)
 				continue // bypass
 			}
@@ -996,10 +1012,10 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, uc *net.UDPConn) (err error
 	return
 }
 
-func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
+func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request, user string) {
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rtcp", addr, conn.RemoteAddr(), user) {
 			log.Logf("Unauthorized to tcp mbind to %s", addr)
 			return
 		}
@@ -1167,7 +1183,7 @@ func (h *socks4Handler) Handle(conn net.Conn) {
 func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	addr := req.Addr.String()
 
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", addr, conn.RemoteAddr(), tlsClientUser(conn)) {
 		log.Logf("[socks4-connect] Unauthorized to tcp connect to %s", addr)
 		rep := gosocks4.NewReply(gosocks4.Rejected, nil)
 		rep.Write(conn)
@@ -1176,7 +1192,7 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 		}
 		return
 	}
-	if h.options.Bypass.Contains(addr) {
+	if h.options.bypass(addr) {
 		log.Log("[socks4-connect] [bypass]", addr)
 		rep := gosocks4.NewReply(gosocks4.Rejected, nil)
 		rep.Write(conn)
@@ -1348,3 +1364,249 @@ func (c *udpTunnelConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 	}
 	return len(b), nil
 }
+
+// DialSOCKS5UDP opens a standard SOCKS5 (RFC 1928) UDP ASSOCIATE session with the last node of the chain,
+// which should be a SOCKS5 proxy, and returns a net.PacketConn to exchange the datagrams with any address through the proxy.
+// The addr of WriteTo can be a domain name address, such as the net.Addr with the String example.com:53.
+//
+// The control connection is established through the chain, and it is closed when the PacketConn is closed,
+// the PacketConn is also closed when the proxy closes the control connection.
+// The datagrams are sent to the relay address of the proxy directly, so it must be reachable from the local host.
+// The fragmented datagrams are not supported, and they are dropped.
+func DialSOCKS5UDP(chain *Chain) (net.PacketConn, error) {
+	if chain.IsEmpty() {
+		return nil, ErrEmptyChain
+	}
+	route, err := chain.selectRoute()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := route.getConn()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := socks5UDPAssociate(conn, route.LastNode())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// dialSOCKS5UDPConn opens a UDP ASSOCIATE session by DialSOCKS5UDP,
+// and returns a net.Conn which exchanges the datagrams with raddr only.
+func dialSOCKS5UDPConn(chain *Chain, raddr string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := DialSOCKS5UDP(chain)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5UDPRemoteConn{PacketConn: pc, raddr: addr}, nil
+}
+
+type socks5UDPRemoteConn struct {
+	net.PacketConn
+	raddr net.Addr
+}
+
+// Read reads a datagram from the remote address, the datagrams from the other addresses are dropped.
+func (c *socks5UDPRemoteConn) Read(b []byte) (n int, err error) {
+	for {
+		var addr net.Addr
+		n, addr, err = c.ReadFrom(b)
+		if err != nil || addr.String() == c.raddr.String() {
+			return
+		}
+	}
+}
+
+func (c *socks5UDPRemoteConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *socks5UDPRemoteConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func socks5UDPAssociate(conn net.Conn, node Node) (*socks5UDPConn, error) {
+	cc, err := socks5Handshake(conn, node.User)
+	if err != nil {
+		return nil, err
+	}
+	conn = cc
+
+	// the client address is unknown if there are any hops before the proxy, so it is always zero.
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	req := gosocks5.NewRequest(gosocks5.CmdUdp, &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "0.0.0.0"})
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if Debug {
+		log.Log("[socks5-udp]", req)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	reply, err := gosocks5.ReadReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if Debug {
+		log.Log("[socks5-udp]", reply)
+	}
+	if reply.Rep != gosocks5.Succeeded || reply.Addr == nil {
+		return nil, errors.New("UDP associate failure")
+	}
+
+	// the unspecified relay address means the address of the proxy.
+	host := reply.Addr.Host
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(node.Addr)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(reply.Addr.Port))))
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &socks5UDPConn{
+		udp:    uc,
+		ctrl:   conn,
+		rbuf:   make([]byte, largeBufferSize),
+		closed: make(chan struct{}),
+	}
+	go c.watch()
+	return c, nil
+}
+
+// socks5UDPConn is a net.PacketConn of the SOCKS5 UDP ASSOCIATE session,
+// the datagrams are encapsulated with the SOCKS5 UDP request header.
+type socks5UDPConn struct {
+	udp       *net.UDPConn // connected to the relay address
+	ctrl      net.Conn     // the control connection
+	rbuf      []byte       // the buffer of ReadFrom
+	rmux      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// watch closes the conn when the control connection is closed.
+func (c *socks5UDPConn) watch() {
+	b := make([]byte, tinyBufferSize)
+	for {
+		if _, err := c.ctrl.Read(b); err != nil {
+			break
+		}
+	}
+	c.Close()
+}
+
+// ReadFrom reads a datagram, the addr is a *net.UDPAddr,
+// or a socks5UDPAddr if the proxy replies with a domain name address, which is not resolved.
+func (c *socks5UDPConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+
+	buf := c.rbuf
+	for {
+		var nn int
+		nn, err = c.udp.Read(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+				err = errors.New("use of closed UDP associate connection")
+			default:
+			}
+			return
+		}
+		dgram, er := gosocks5.ReadUDPDatagram(bytes.NewReader(buf[:nn]))
+		if er != nil || dgram.Header.Frag != 0 {
+			continue // drop the invalid or fragmented datagrams
+		}
+		n = copy(b, dgram.Data)
+		addr = socks5UDPAddrOf(dgram.Header.Addr)
+		return
+	}
+}
+
+// socks5UDPAddr is the domain name address of the datagram from the SOCKS5 proxy.
+type socks5UDPAddr struct {
+	host string
+	port int
+}
+
+// socks5UDPAddrOf converts the address of the datagram to a net.Addr.
+func socks5UDPAddrOf(addr *gosocks5.Addr) net.Addr {
+	if addr == nil {
+		return &net.UDPAddr{}
+	}
+	if ip := net.ParseIP(addr.Host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(addr.Port)}
+	}
+	return &socks5UDPAddr{host: addr.Host, port: int(addr.Port)}
+}
+
+func (a *socks5UDPAddr) Network() string {
+	return "udp"
+}
+
+func (a *socks5UDPAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+func (c *socks5UDPConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	p, _ := strconv.Atoi(port)
+	socksAddr := &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: host, Port: uint16(p)}
+	if ip := net.ParseIP(host); ip != nil {
+		socksAddr.Type = gosocks5.AddrIPv6
+		if ip.To4() != nil {
+			socksAddr.Type = gosocks5.AddrIPv4
+		}
+	}
+
+	buf := bytes.Buffer{}
+	dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, socksAddr), b)
+	if err = dgram.Write(&buf); err != nil {
+		return
+	}
+	if _, err = c.udp.Write(buf.Bytes()); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.ctrl.Close()
+		c.udp.Close()
+	})
+	return nil
+}
+
+func (c *socks5UDPConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *socks5UDPConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *socks5UDPConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *socks5UDPConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
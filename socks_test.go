@@ -0,0 +1,101 @@
+package gost
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestDialSOCKS5UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&Server{Listener: ln}).Serve(SOCKS5Handler(
+		TLSConfigHandlerOption(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	))
+
+	if _, err := DialSOCKS5UDP(nil); err != ErrEmptyChain {
+		t.Errorf("empty chain should return ErrEmptyChain, got %v", err)
+	}
+
+	chain := NewChain(Node{
+		Addr:     ln.Addr().String(),
+		Protocol: "socks5",
+		Client: &Client{
+			Connector:   SOCKS5Connector(nil),
+			Transporter: TCPTransporter(),
+		},
+	})
+	pc, err := DialSOCKS5UDP(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		b := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg || addr.String() != echo.LocalAddr().String() {
+			t.Errorf("got %q from %s, want %q from %s", b[:n], addr, msg, echo.LocalAddr())
+		}
+	}
+
+	// closing the conn closes the control connection, and the session is over.
+	pc.Close()
+	if _, _, err := pc.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Error("read from closed conn should fail")
+	}
+}
+
+func TestSOCKS5UDPAddr(t *testing.T) {
+	var tests = []struct {
+		addr    *gosocks5.Addr
+		network string
+		s       string
+	}{
+		{&gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "1.2.3.4", Port: 53}, "udp", "1.2.3.4:53"},
+		{&gosocks5.Addr{Type: gosocks5.AddrIPv6, Host: "2001:db8::1", Port: 53}, "udp", "[2001:db8::1]:53"},
+		{&gosocks5.Addr{Type: gosocks5.AddrDomain, Host: "unresolvable.invalid", Port: 53}, "udp", "unresolvable.invalid:53"},
+	}
+	for _, test := range tests {
+		addr := socks5UDPAddrOf(test.addr)
+		if addr.Network() != test.network || addr.String() != test.s {
+			t.Errorf("%v: got %s %s, want %s %s", test.addr, addr.Network(), addr, test.network, test.s)
+		}
+		if _, ok := addr.(*net.UDPAddr); ok != (test.addr.Type != gosocks5.AddrDomain) {
+			t.Errorf("%v: got %T", test.addr, addr)
+		}
+	}
+}
@@ -1,19 +1,30 @@
 package gost
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ginuerzh/gosocks5"
 	"github.com/go-log/log"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 // Due to in/out byte length is inconsistent of the shadowsocks.Conn.Write,
@@ -56,6 +67,67 @@ func (c *shadowConn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
+// shadowCipher creates the encrypted connections of shadowsocks.
+type shadowCipher interface {
+	// Client wraps the connection to the server, and sends the target address in the SOCKS5 format.
+	Client(conn net.Conn, rawaddr []byte) (net.Conn, error)
+	// Server wraps the connection from the client.
+	Server(conn net.Conn) net.Conn
+	// PacketConn wraps the UDP relay connection.
+	PacketConn(conn net.PacketConn) net.PacketConn
+}
+
+// newShadowCipher creates the cipher of the method,
+// it is an AEAD cipher (aes-128-gcm, aes-192-gcm, aes-256-gcm, chacha20-ietf-poly1305),
+// or a stream cipher supported by the shadowsocks library.
+func newShadowCipher(method, password string) (shadowCipher, error) {
+	if info, ok := shadowAEADMethods[method]; ok {
+		if password == "" {
+			return nil, errors.New("ss: empty password")
+		}
+		return &shadowAEADCipher{
+			info: info,
+			key:  shadowKey(password, info.keySize),
+		}, nil
+	}
+
+	cipher, err := ss.NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowStreamCipher{cipher: cipher}, nil
+}
+
+func userShadowCipher(user *url.Userinfo) (shadowCipher, error) {
+	var method, password string
+	if user != nil {
+		method = user.Username()
+		password, _ = user.Password()
+	}
+	return newShadowCipher(method, password)
+}
+
+// shadowStreamCipher is the legacy stream cipher, such as aes-256-cfb and chacha20.
+type shadowStreamCipher struct {
+	cipher *ss.Cipher
+}
+
+func (c *shadowStreamCipher) Client(conn net.Conn, rawaddr []byte) (net.Conn, error) {
+	sc, err := ss.DialWithRawAddrConn(rawaddr, conn, c.cipher.Copy())
+	if err != nil {
+		return nil, err
+	}
+	return &shadowConn{conn: sc}, nil
+}
+
+func (c *shadowStreamCipher) Server(conn net.Conn) net.Conn {
+	return &shadowConn{conn: ss.NewConn(conn, c.cipher.Copy())}
+}
+
+func (c *shadowStreamCipher) PacketConn(conn net.PacketConn) net.PacketConn {
+	return ss.NewSecurePacketConn(conn, c.cipher.Copy(), false)
+}
+
 type shadowConnector struct {
 	Cipher *url.Userinfo
 }
@@ -73,29 +145,45 @@ func (c *shadowConnector) Connect(conn net.Conn, addr string) (net.Conn, error)
 		return nil, err
 	}
 
-	var method, password string
-	if c.Cipher != nil {
-		method = c.Cipher.Username()
-		password, _ = c.Cipher.Password()
-	}
-
-	cipher, err := ss.NewCipher(method, password)
+	cipher, err := userShadowCipher(c.Cipher)
 	if err != nil {
 		return nil, err
 	}
-
-	sc, err := ss.DialWithRawAddrConn(rawaddr, conn, cipher)
-	if err != nil {
-		return nil, err
-	}
-	return &shadowConn{conn: sc}, nil
+	return cipher.Client(conn, rawaddr)
 }
 
 type shadowHandler struct {
-	options *HandlerOptions
+	options   *HandlerOptions
+	userCache map[string]string // the name of the user identified for the client IP
+	keys      []shadowUser      // the keys of the users, they are created again only if the users are changed
+	keysID    string            // the users of the keys
+	filter    *replayFilter
+	mux       sync.Mutex
+}
+
+// shadowUser is the key of a user of the shadowsocks server.
+type shadowUser struct {
+	name   string
+	cipher shadowCipher
 }
 
+const (
+	// shadowMaxUserCache is the max number of the client IPs of the user cache.
+	shadowMaxUserCache = 1024
+	// shadowReplayCapacity is the number of the salts of each bloom filter of the replay filter.
+	shadowReplayCapacity = 100000
+	// shadowReplayFPRate is the false positive rate of the replay filter.
+	shadowReplayFPRate = 1e-6
+)
+
+var errShadowReplay = errors.New("replayed salt")
+
 // ShadowHandler creates a server Handler for shadowsocks proxy server.
+// The cipher method and the default password are the ones of the user in the form of method:password,
+// the other users (the users of the Users option and the users listed by the Authenticator, such as the users in the secrets file)
+// use the same method with their own passwords,
+// and the user of the connection is identified by the key of the AEAD cipher.
+// For the legacy stream ciphers, only the first key is used as the user can not be identified.
 func ShadowHandler(opts ...HandlerOption) Handler {
 	h := &shadowHandler{}
 	h.Init(opts...)
@@ -111,43 +199,215 @@ func (h *shadowHandler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
+
+	h.userCache = make(map[string]string)
+	if h.filter == nil {
+		h.filter = newReplayFilter(shadowReplayCapacity, shadowReplayFPRate)
+	}
 }
 
-func (h *shadowHandler) Handle(conn net.Conn) {
-	defer conn.Close()
+// isShadowMethod reports whether the method is a cipher method of shadowsocks.
+func isShadowMethod(method string) bool {
+	if _, ok := shadowAEADMethods[method]; ok {
+		return true
+	}
+	method = strings.TrimSuffix(strings.ToLower(method), "-auth")
+	return method != "" && ss.CheckCipherMethod(method) == nil
+}
 
-	var method, password string
+// users returns the keys of the users of the Users option and the users listed by the Authenticator,
+// so the users reloaded from the secrets file are used by the new connections.
+// The keys are cached until the users are changed, as deriving the keys is expensive.
+func (h *shadowHandler) users() ([]shadowUser, error) {
 	users := h.options.Users
-	if len(users) > 0 {
-		method = users[0].Username()
-		password, _ = users[0].Password()
+	if lister, ok := h.options.Authenticator.(UserLister); ok {
+		users = append(users[:len(users):len(users)], lister.Users()...)
 	}
-	cipher, err := ss.NewCipher(method, password)
+
+	var b strings.Builder
+	for _, user := range users {
+		if user != nil {
+			password, _ := user.Password()
+			fmt.Fprintf(&b, "%q:%q\n", user.Username(), password)
+		}
+	}
+	id := b.String()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.keys != nil && h.keysID == id {
+		return h.keys, nil
+	}
+	keys, err := shadowUsers(users)
 	if err != nil {
-		log.Log("[ss]", err)
-		return
+		return nil, err
+	}
+	h.keys, h.keysID = keys, id
+	return keys, nil
+}
+
+// shadowUsers creates the keys of the users, the method is the username of the first user with a cipher method,
+// which is the anonymous user, the other users use their names, and only the first one of the same name is used.
+// The users of the empty password or the same password as a previous user are skipped,
+// as the user of a connection is identified by the key.
+func shadowUsers(users []*url.Userinfo) ([]shadowUser, error) {
+	var method string
+	var keys []shadowUser
+	passwords := make(map[string]string) // the user names of the passwords
+	for _, user := range users {
+		if user != nil && isShadowMethod(user.Username()) {
+			method = user.Username()
+			password, _ := user.Password()
+			cipher, err := newShadowCipher(method, password)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, shadowUser{cipher: cipher})
+			passwords[password] = method
+			break
+		}
+	}
+	if method == "" {
+		_, err := userShadowCipher(nil)
+		return nil, err
 	}
-	conn = &shadowConn{conn: ss.NewConn(conn, cipher)}
+
+	names := map[string]bool{method: true}
+	for _, user := range users {
+		if user == nil || names[user.Username()] {
+			continue
+		}
+		names[user.Username()] = true
+		password, _ := user.Password()
+		if password == "" {
+			log.Logf("[ss] user %s: empty password, skipped", user.Username())
+			continue
+		}
+		if name, ok := passwords[password]; ok {
+			log.Logf("[ss] user %s: the same password as %s, skipped", user.Username(), name)
+			continue
+		}
+		cipher, err := newShadowCipher(method, password)
+		if err != nil {
+			log.Logf("[ss] user %s: %s, skipped", user.Username(), err)
+			continue
+		}
+		passwords[password] = user.Username()
+		keys = append(keys, shadowUser{name: user.Username(), cipher: cipher})
+	}
+	return keys, nil
+}
+
+// serverConn identifies the user of the connection from the client,
+// each key is tried against the salt and the first length chunk of the AEAD stream,
+// the user identified for the client IP last time is tried first.
+// The salt of the AEAD stream is rejected if it is replayed.
+func (h *shadowHandler) serverConn(conn net.Conn) (net.Conn, string, error) {
+	users, err := h.users()
+	if err != nil {
+		return nil, "", err
+	}
+	aeadCipher, ok := users[0].cipher.(*shadowAEADCipher)
+	if !ok {
+		return users[0].cipher.Server(conn), users[0].name, nil
+	}
+
+	ip := addrIP(conn.RemoteAddr())
+	if h.options.AuthGuard.Banned(ip) {
+		return nil, "", errors.New("banned")
+	}
+
+	info := aeadCipher.info
+	br := bufio.NewReader(conn)
+	header, err := br.Peek(info.saltSize + 2 + 16) // all the AEAD ciphers have the 16 bytes tag
+	if err != nil {
+		return nil, "", err
+	}
+	salt, chunk := header[:info.saltSize], header[info.saltSize:]
+
+	h.mux.Lock()
+	cached, ok := h.userCache[ip.String()]
+	h.mux.Unlock()
+
+	order := make([]int, 0, len(users))
+	for i := range users {
+		if ok && users[i].name == cached {
+			order = append([]int{i}, order...)
+		} else {
+			order = append(order, i)
+		}
+	}
+
+	for _, i := range order {
+		aead, err := users[i].cipher.(*shadowAEADCipher).aead(salt)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := aead.Open(nil, make([]byte, aead.NonceSize()), chunk, nil); err != nil {
+			continue
+		}
+
+		if h.filter.Check(salt) {
+			return nil, "", errShadowReplay
+		}
+
+		h.mux.Lock()
+		if len(h.userCache) >= shadowMaxUserCache {
+			h.userCache = make(map[string]string)
+		}
+		h.userCache[ip.String()] = users[i].name
+		h.mux.Unlock()
+
+		h.options.AuthGuard.Succeed(ip)
+		user := users[i]
+		return user.cipher.Server(&bufferdConn{Conn: conn, br: br}), user.name, nil
+	}
+
+	h.options.AuthGuard.Fail(ip, "")
+	return nil, "", errors.New("no user key matched")
+}
+
+func (h *shadowHandler) Handle(conn net.Conn) {
+	defer conn.Close()
 
 	log.Logf("[ss] %s - %s", conn.RemoteAddr(), conn.LocalAddr())
 
+	// the invalid or replayed connections are drained silently until the timeout,
+	// so the server does not respond to the probes differently from a silent service.
+	raw := conn
 	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	sc, user, err := h.serverConn(conn)
+	if err != nil {
+		log.Logf("[ss] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		io.Copy(ioutil.Discard, raw)
+		return
+	}
+	conn = sc
+
 	addr, err := h.getRequest(conn)
 	if err != nil {
 		log.Logf("[ss] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		io.Copy(ioutil.Discard, raw)
 		return
 	}
 	// clear timer
 	conn.SetReadDeadline(time.Time{})
 
-	log.Logf("[ss] %s -> %s", conn.RemoteAddr(), addr)
+	var su string
+	if user != "" {
+		su = user + "@"
+	}
 
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
-		log.Logf("[ss] Unauthorized to tcp connect to %s", addr)
+	log.Logf("[ss] %s%s -> %s", su, conn.RemoteAddr(), addr)
+
+	if !h.options.can("tcp", addr, conn.RemoteAddr(), user) {
+		log.Logf("[ss] %sUnauthorized to tcp connect to %s", su, addr)
 		return
 	}
 
-	if h.options.Bypass.Contains(addr) {
+	if h.options.bypass(addr) {
 		log.Logf("[ss] [bypass] %s", addr)
 		return
 	}
@@ -159,14 +419,14 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 		ResolverChainOption(h.options.Resolver),
 	)
 	if err != nil {
-		log.Logf("[ss] %s -> %s : %s", conn.RemoteAddr(), addr, err)
+		log.Logf("[ss] %s%s -> %s : %s", su, conn.RemoteAddr(), addr, err)
 		return
 	}
 	defer cc.Close()
 
-	log.Logf("[ss] %s <-> %s", conn.RemoteAddr(), addr)
+	log.Logf("[ss] %s%s <-> %s", su, conn.RemoteAddr(), addr)
 	transport(conn, cc)
-	log.Logf("[ss] %s >-< %s", conn.RemoteAddr(), addr)
+	log.Logf("[ss] %s%s >-< %s", su, conn.RemoteAddr(), addr)
 }
 
 const (
@@ -244,6 +504,7 @@ type shadowUDPListener struct {
 }
 
 // ShadowUDPListener creates a Listener for shadowsocks UDP relay server.
+// The packets are encrypted by the single cipher, the multiple users of the secrets file are not supported.
 func ShadowUDPListener(addr string, cipher *url.Userinfo, ttl time.Duration) (Listener, error) {
 	laddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -254,18 +515,17 @@ func ShadowUDPListener(addr string, cipher *url.Userinfo, ttl time.Duration) (Li
 		return nil, err
 	}
 
-	var method, password string
-	if cipher != nil {
-		method = cipher.Username()
-		password, _ = cipher.Password()
-	}
-	cp, err := ss.NewCipher(method, password)
+	cp, err := userShadowCipher(cipher)
 	if err != nil {
 		ln.Close()
 		return nil, err
 	}
+	pc := cp.PacketConn(ln)
+	if c, ok := pc.(*shadowAEADPacketConn); ok {
+		c.filter = newReplayFilter(shadowReplayCapacity, shadowReplayFPRate)
+	}
 	l := &shadowUDPListener{
-		ln:       ss.NewSecurePacketConn(ln, cp, false),
+		ln:       pc,
 		conns:    make(map[string]*udpServerConn),
 		connChan: make(chan net.Conn, 1024),
 		errChan:  make(chan error, 1),
@@ -406,7 +666,7 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 				errc <- err
 				return
 			}
-			if h.options.Bypass.Contains(addr.String()) {
+			if h.options.bypass(addr.String()) {
 				log.Log("[ssu] [bypass] write to", addr)
 				continue // bypass
 			}
@@ -428,7 +688,7 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 			if Debug {
 				log.Logf("[ssu] %s <<< %s length: %d", sc.RemoteAddr(), addr, n)
 			}
-			if h.options.Bypass.Contains(addr.String()) {
+			if h.options.bypass(addr.String()) {
 				log.Log("[ssu] [bypass] read from", addr)
 				continue // bypass
 			}
@@ -452,3 +712,253 @@ func (h *shadowUDPdHandler) transportUDP(sc net.Conn, cc net.PacketConn) error {
 	}
 	return err
 }
+
+type shadowAEADInfo struct {
+	keySize  int
+	saltSize int
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+}
+
+func newShadowGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var shadowAEADMethods = map[string]*shadowAEADInfo{
+	"aes-128-gcm":            {16, 16, newShadowGCM},
+	"aes-192-gcm":            {24, 24, newShadowGCM},
+	"aes-256-gcm":            {32, 32, newShadowGCM},
+	"chacha20-ietf-poly1305": {32, 32, chacha20poly1305.New},
+}
+
+const (
+	// shadowAEADMaxPayload is the max size of the payload of a chunk in the TCP stream.
+	shadowAEADMaxPayload = 0x3FFF
+)
+
+// shadowKey derives the master key from the password, it is the EVP_BytesToKey of OpenSSL with MD5.
+func shadowKey(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keySize]
+}
+
+// shadowAEADCipher is the AEAD cipher of shadowsocks (SIP004),
+// the session key of each connection or packet is derived from the master key and a random salt by HKDF-SHA1.
+type shadowAEADCipher struct {
+	info *shadowAEADInfo
+	key  []byte
+}
+
+func (c *shadowAEADCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.info.keySize)
+	r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return c.info.newAEAD(subkey)
+}
+
+func (c *shadowAEADCipher) Client(conn net.Conn, rawaddr []byte) (net.Conn, error) {
+	sc := c.Server(conn)
+	if _, err := sc.Write(rawaddr); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (c *shadowAEADCipher) Server(conn net.Conn) net.Conn {
+	return &shadowAEADConn{Conn: conn, cipher: c}
+}
+
+func (c *shadowAEADCipher) PacketConn(conn net.PacketConn) net.PacketConn {
+	return &shadowAEADPacketConn{PacketConn: conn, cipher: c}
+}
+
+// shadowAEADConn is the TCP stream of the AEAD cipher, it starts with the salt,
+// then the chunks, each chunk is the encrypted 2 bytes length of the payload and the encrypted payload.
+// The nonce is a little-endian counter from zero, which is incremented after each encryption or decryption.
+type shadowAEADConn struct {
+	net.Conn
+	cipher   *shadowAEADCipher
+	enc      cipher.AEAD
+	encNonce []byte
+	dec      cipher.AEAD
+	decNonce []byte
+	rbuf     []byte // the buffer of the chunk
+	rdata    []byte // the unread payload in rbuf
+	wbuf     []byte
+}
+
+func (c *shadowAEADConn) Read(b []byte) (n int, err error) {
+	if len(c.rdata) == 0 {
+		if err = c.readChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.rdata)
+	c.rdata = c.rdata[n:]
+	return
+}
+
+func (c *shadowAEADConn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.info.saltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return err
+		}
+		c.dec = aead
+		c.decNonce = make([]byte, aead.NonceSize())
+		c.rbuf = make([]byte, shadowAEADMaxPayload+aead.Overhead())
+	}
+
+	overhead := c.dec.Overhead()
+	buf := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	if _, err := c.dec.Open(buf[:0], c.decNonce, buf, nil); err != nil {
+		return err
+	}
+	shadowIncNonce(c.decNonce)
+
+	size := int(binary.BigEndian.Uint16(buf)) & shadowAEADMaxPayload
+	buf = c.rbuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	data, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return err
+	}
+	shadowIncNonce(c.decNonce)
+	c.rdata = data
+	return nil
+}
+
+func (c *shadowAEADConn) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return // the zero length chunk is not allowed
+	}
+
+	var salt []byte
+	if c.enc == nil {
+		salt = make([]byte, c.cipher.info.saltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc = aead
+		c.encNonce = make([]byte, aead.NonceSize())
+		c.wbuf = make([]byte, 0, 2+aead.Overhead()+shadowAEADMaxPayload+aead.Overhead())
+	}
+
+	for n < len(b) {
+		payload := b[n:]
+		if len(payload) > shadowAEADMaxPayload {
+			payload = payload[:shadowAEADMaxPayload]
+		}
+
+		chunk := c.wbuf[:2]
+		binary.BigEndian.PutUint16(chunk, uint16(len(payload)))
+		chunk = c.enc.Seal(chunk[:0], c.encNonce, chunk, nil)
+		shadowIncNonce(c.encNonce)
+		chunk = c.enc.Seal(chunk, c.encNonce, payload, nil)
+		shadowIncNonce(c.encNonce)
+
+		if salt != nil {
+			// the salt is sent with the first chunk
+			chunk = append(salt, chunk...)
+			salt = nil
+		}
+		if _, err = c.Conn.Write(chunk); err != nil {
+			return
+		}
+		n += len(payload)
+	}
+	return
+}
+
+func shadowIncNonce(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// shadowAEADPacketConn is the UDP relay connection of the AEAD cipher,
+// each packet is the salt and the payload encrypted by the zero nonce.
+// The packets failed to decrypt, or with the replayed salts if the filter is set, are dropped.
+type shadowAEADPacketConn struct {
+	net.PacketConn
+	cipher *shadowAEADCipher
+	filter *replayFilter
+}
+
+func (c *shadowAEADPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	saltSize := c.cipher.info.saltSize
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		var aead cipher.AEAD
+		if n >= saltSize {
+			aead, err = c.cipher.aead(b[:saltSize])
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if aead == nil || n < saltSize+aead.Overhead() {
+			log.Logf("[ss] %s - %s : short packet", addr, c.LocalAddr())
+			continue
+		}
+		data, err := aead.Open(b[saltSize:saltSize], make([]byte, aead.NonceSize()), b[saltSize:n], nil)
+		if err != nil {
+			log.Logf("[ss] %s - %s : %s", addr, c.LocalAddr(), err)
+			continue
+		}
+		if c.filter.Check(b[:saltSize]) {
+			log.Logf("[ss] %s - %s : %s", addr, c.LocalAddr(), errShadowReplay)
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+func (c *shadowAEADPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	saltSize := c.cipher.info.saltSize
+	buf := make([]byte, saltSize, saltSize+len(b)+16)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.aead(buf)
+	if err != nil {
+		return 0, err
+	}
+	buf = aead.Seal(buf, make([]byte, aead.NonceSize()), b, nil)
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,488 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var shadowCipherTests = []string{
+	"aes-128-gcm",
+	"aes-192-gcm",
+	"aes-256-gcm",
+	"chacha20-ietf-poly1305",
+	"aes-256-cfb",
+	"chacha20",
+}
+
+func shadowRoundtrip(targetURL string, cliCipher *url.Userinfo, data []byte, opts ...HandlerOption) ([]byte, error) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(ShadowHandler(opts...))
+	defer server.Close()
+
+	client := &Client{
+		Connector:   ShadowConnector(cliCipher),
+		Transporter: TCPTransporter(),
+	}
+	conn, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err = client.Connect(conn, u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func TestShadowCipher(t *testing.T) {
+	// the request body is read before the response is written, as the HTTP/1.x server can not read it after.
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer httpSrv.Close()
+
+	// the payload is larger than the max chunk size of the AEAD ciphers
+	data := make([]byte, 3*shadowAEADMaxPayload+100)
+	rand.Read(data)
+
+	for _, method := range shadowCipherTests {
+		cipher := url.UserPassword(method, "123456")
+		recv, err := shadowRoundtrip(httpSrv.URL, cipher, data, UsersHandlerOption(cipher))
+		if err != nil {
+			t.Errorf("%s: %v", method, err)
+			continue
+		}
+		if !bytes.Equal(recv, data) {
+			t.Errorf("%s: got %d bytes, want %d bytes", method, len(recv), len(data))
+		}
+	}
+
+	if _, err := shadowRoundtrip(httpSrv.URL, url.UserPassword("aes-256-gcm", "123456"), data,
+		UsersHandlerOption(url.UserPassword("aes-256-gcm", "654321"))); err == nil {
+		t.Error("the request with the wrong password should fail")
+	}
+	if _, err := newShadowCipher("aes-256-gcm", ""); err == nil {
+		t.Error("the empty password should be rejected")
+	}
+	if _, err := newShadowCipher("unknown", "123456"); err == nil {
+		t.Error("the unknown method should be rejected")
+	}
+}
+
+func TestShadowMultiUser(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	// the users of the secrets file are listed by the Authenticator
+	au := NewLocalAuthenticator(map[string]string{"aes-256-gcm": "nodepass"})
+	au.Reload(bytes.NewBufferString("alice alicepass\nbob bobpass blacklist=tcp:*:*\ncarol $apr1$salt$hash"))
+	opts := []HandlerOption{
+		UsersHandlerOption(url.UserPassword("aes-256-gcm", "nodepass")),
+		AuthenticatorHandlerOption(au),
+	}
+
+	for _, test := range []struct {
+		password string
+		ok       bool
+	}{
+		{"nodepass", true},
+		{"alicepass", true},
+		{"alicepass", true}, // identified by the cache
+		{"bobpass", false},  // forbidden by the permissions of bob
+		{"wrongpass", false},
+	} {
+		data := []byte("hello " + test.password)
+		recv, err := shadowRoundtrip(httpSrv.URL, url.UserPassword("aes-256-gcm", test.password), data, opts...)
+		if ok := err == nil && bytes.Equal(recv, data); ok != test.ok {
+			t.Errorf("%s: got %q %v, want ok %v", test.password, recv, err, test.ok)
+		}
+	}
+
+	users, err := shadowUsers([]*url.Userinfo{url.UserPassword("alice", "alicepass")})
+	if err == nil {
+		t.Errorf("the users without the cipher method should be rejected, got %v", users)
+	}
+	// the users of the empty or the same password are skipped.
+	for _, test := range []struct {
+		users []*url.Userinfo
+		names string
+	}{
+		{[]*url.Userinfo{url.UserPassword("aes-256-gcm", "nodepass"), url.UserPassword("alice", "samepass"), url.UserPassword("bob", "samepass")}, "[ alice]"},
+		{[]*url.Userinfo{url.UserPassword("aes-256-gcm", "nodepass"), url.UserPassword("alice", "nodepass")}, "[]"},
+		{[]*url.Userinfo{url.UserPassword("aes-256-gcm", "nodepass"), url.User("alice"), url.UserPassword("bob", "bobpass")}, "[ bob]"},
+	} {
+		users, err := shadowUsers(test.users)
+		if err != nil {
+			t.Errorf("%v: %v", test.users, err)
+			continue
+		}
+		var names []string
+		for _, user := range users {
+			names = append(names, user.name)
+		}
+		if s := fmt.Sprint(names); s != test.names {
+			t.Errorf("%v: got users %s, want %s", test.users, s, test.names)
+		}
+	}
+
+	// the keys are cached until the users are reloaded.
+	h := ShadowHandler(opts...).(*shadowHandler)
+	keys1, _ := h.users()
+	keys2, _ := h.users()
+	if len(keys1) != 3 || len(keys2) != 3 || keys1[1].cipher != keys2[1].cipher {
+		t.Errorf("the keys should be cached, got %v, %v", keys1, keys2)
+	}
+	au.Reload(bytes.NewBufferString("alice newpass"))
+	keys3, _ := h.users()
+	if len(keys3) != 2 || keys3[1].cipher == keys1[1].cipher {
+		t.Errorf("the keys should be created again after reloading, got %v", keys3)
+	}
+}
+
+// shadowTestSubkey derives the session key by HKDF-SHA1 as specified in SIP004.
+func shadowTestSubkey(password string, salt []byte, keySize int) []byte {
+	// EVP_BytesToKey
+	var key, d []byte
+	for len(key) < keySize {
+		h := md5.Sum(append(d, password...))
+		d = h[:]
+		key = append(key, d...)
+	}
+	key = key[:keySize]
+
+	// HKDF extract and expand
+	mac := hmac.New(sha1.New, salt)
+	mac.Write(key)
+	prk := mac.Sum(nil)
+	var okm, t []byte
+	for i := byte(1); len(okm) < keySize; i++ {
+		mac = hmac.New(sha1.New, prk)
+		mac.Write(t)
+		mac.Write([]byte("ss-subkey"))
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:keySize]
+}
+
+func TestShadowAEADWireFormat(t *testing.T) {
+	for _, test := range []struct {
+		method  string
+		newAEAD func([]byte) (cipher.AEAD, error)
+	}{
+		{"aes-128-gcm", func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}},
+		{"chacha20-ietf-poly1305", chacha20poly1305.New},
+	} {
+		keySize := shadowAEADMethods[test.method].keySize
+		c, err := newShadowCipher(test.method, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		cc := c.Server(&bufferConn{Buffer: &buf})
+		rawaddr := []byte{typeIPv4, 1, 2, 3, 4, 0, 80}
+		if _, err := cc.Write(rawaddr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cc.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		// decrypt the stream independently
+		salt := buf.Next(keySize)
+		aead, err := test.newAEAD(shadowTestSubkey("secret", salt, keySize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		var payloads [][]byte
+		for buf.Len() > 0 {
+			b, err := aead.Open(nil, nonce, buf.Next(2+aead.Overhead()), nil)
+			if err != nil {
+				t.Fatalf("%s: length: %v", test.method, err)
+			}
+			nonce[0]++
+			size := int(binary.BigEndian.Uint16(b))
+			b, err = aead.Open(nil, nonce, buf.Next(size+aead.Overhead()), nil)
+			if err != nil {
+				t.Fatalf("%s: payload: %v", test.method, err)
+			}
+			nonce[0]++
+			payloads = append(payloads, b)
+		}
+		if len(payloads) != 2 || !bytes.Equal(payloads[0], rawaddr) || string(payloads[1]) != "hello" {
+			t.Errorf("%s: got %q", test.method, payloads)
+		}
+
+		// encrypt a packet independently
+		salt = make([]byte, keySize)
+		rand.Read(salt)
+		aead, _ = test.newAEAD(shadowTestSubkey("secret", salt, keySize))
+		packet := aead.Seal(salt, make([]byte, aead.NonceSize()), []byte("packet"), nil)
+		pc := c.PacketConn(&bufferPacketConn{packets: [][]byte{[]byte("invalid"), packet}})
+		b := make([]byte, 1500)
+		n, _, err := pc.ReadFrom(b)
+		if err != nil || string(b[:n]) != "packet" {
+			t.Errorf("%s: got packet %q %v", test.method, b[:n], err)
+		}
+	}
+}
+
+func TestShadowUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	for _, method := range []string{"aes-256-gcm", "chacha20-ietf-poly1305", "aes-256-cfb"} {
+		cipher := url.UserPassword(method, "123456")
+		ln, err := ShadowUDPListener("127.0.0.1:0", cipher, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{Listener: ln}
+		go server.Serve(ShadowUDPdHandler())
+
+		c, err := userShadowCipher(cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := c.PacketConn(conn)
+
+		// the reply is from the address of the request
+		b := make([]byte, 1500)
+		n, err := toSocksAddr(echo.LocalAddr()).Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := append(b[:n:n], "hello"...)
+		if _, err := pc.WriteTo(msg, ln.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err = pc.ReadFrom(b)
+		if err != nil {
+			t.Errorf("%s: %v", method, err)
+		} else if !bytes.Equal(b[:n], msg) {
+			t.Errorf("%s: got %q, want %q", method, b[:n], msg)
+		}
+		pc.Close()
+		server.Close()
+	}
+}
+
+// bufferConn is a net.Conn writing to the buffer.
+type bufferConn struct {
+	net.Conn
+	*bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.Buffer.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.Buffer.Write(b) }
+
+// bufferPacketConn is a net.PacketConn reading the packets.
+type bufferPacketConn struct {
+	net.PacketConn
+	packets [][]byte
+}
+
+func (c *bufferPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.packets) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(b, c.packets[0])
+	c.packets = c.packets[1:]
+	return n, &net.UDPAddr{}, nil
+}
+
+func (c *bufferPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := newReplayFilter(100, 1e-6)
+	key := func(i int) []byte {
+		return []byte(strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		if f.Check(key(i)) {
+			t.Fatalf("%d: false positive", i)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if !f.Check(key(i)) {
+			t.Fatalf("%d: replay is not detected", i)
+		}
+	}
+
+	// the filter is rotated, the items are remembered by the previous filter.
+	for i := 100; i < 200; i++ {
+		if f.Check(key(i)) {
+			t.Fatalf("%d: false positive", i)
+		}
+	}
+	if !f.Check(key(0)) || !f.Check(key(199)) {
+		t.Error("replay is not detected after the rotation")
+	}
+
+	// the oldest items are dropped after the second rotation.
+	for i := 200; i < 300; i++ {
+		f.Check(key(i))
+	}
+	if f.Check(key(0)) {
+		t.Error("the dropped item should not be detected")
+	}
+
+	if (*replayFilter)(nil).Check(key(0)) {
+		t.Error("nil filter should not detect replay")
+	}
+}
+
+func TestShadowReplay(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	cipher := url.UserPassword("aes-256-gcm", "123456")
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(ShadowHandler(UsersHandlerOption(cipher)))
+	defer server.Close()
+
+	// the captured first packet of a client
+	c, err := userShadowCipher(cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawaddr, err := ss.RawAddr(strings.TrimPrefix(httpSrv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet bytes.Buffer
+	cc, err := c.Client(&bufferConn{Buffer: &packet}, rawaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, httpSrv.URL, nil)
+	req.Write(cc)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(packet.Bytes())
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = http.ReadResponse(bufio.NewReader(c.Server(conn)), req)
+		conn.Close()
+
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// the replayed packet gets no response, and the connection is not closed by the server.
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Errorf("the replay should time out, got %v", err)
+			}
+		}
+	}
+
+	// the replayed UDP packets are dropped
+	var packets [][]byte
+	for _, s := range []string{"packet1", "packet2"} {
+		pc := &bufferPacketConn{}
+		cpc := &captureWriteConn{bufferPacketConn: pc}
+		c.PacketConn(cpc).WriteTo([]byte(s), &net.UDPAddr{})
+		packets = append(packets, cpc.packet)
+	}
+	pc := c.PacketConn(&bufferPacketConn{packets: [][]byte{packets[0], packets[0], packets[1]}})
+	pc.(*shadowAEADPacketConn).filter = newReplayFilter(10, 1e-6)
+	b := make([]byte, 1500)
+	for _, want := range []string{"packet1", "packet2"} {
+		n, _, err := pc.ReadFrom(b)
+		if err != nil || string(b[:n]) != want {
+			t.Errorf("got %q %v, want %q", b[:n], err, want)
+		}
+	}
+}
+
+// captureWriteConn is a net.PacketConn keeping the written packet.
+type captureWriteConn struct {
+	*bufferPacketConn
+	packet []byte
+}
+
+func (c *captureWriteConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.packet = append([]byte(nil), b...)
+	return len(b), nil
+}
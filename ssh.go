@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -152,24 +153,14 @@ func (tr *sshForwardTransporter) Handshake(conn net.Conn, options ...HandshakeOp
 		option(opts)
 	}
 
-	config := ssh.ClientConfig{
-		Timeout:         opts.Timeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	if opts.User != nil {
-		config.User = opts.User.Username()
-		password, _ := opts.User.Password()
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(password),
-		}
-	}
+	config := sshClientConfig(opts)
 
 	tr.sessionMutex.Lock()
 	defer tr.sessionMutex.Unlock()
 
 	session, ok := tr.sessions[opts.Addr]
 	if !ok || session.client == nil {
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, &config)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, config)
 		if err != nil {
 			conn.Close()
 			delete(tr.sessions, opts.Addr)
@@ -248,24 +239,14 @@ func (tr *sshTunnelTransporter) Handshake(conn net.Conn, options ...HandshakeOpt
 		option(opts)
 	}
 
-	config := ssh.ClientConfig{
-		Timeout:         opts.Timeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	if opts.User != nil {
-		config.User = opts.User.Username()
-		password, _ := opts.User.Password()
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(password),
-		}
-	}
+	config := sshClientConfig(opts)
 
 	tr.sessionMutex.Lock()
 	defer tr.sessionMutex.Unlock()
 
 	session, ok := tr.sessions[opts.Addr]
 	if !ok || session.client == nil {
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, &config)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, opts.Addr, config)
 		if err != nil {
 			conn.Close()
 			delete(tr.sessions, opts.Addr)
@@ -422,10 +403,16 @@ func (h *sshForwardHandler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.resolveAuthenticator()
 	h.config = &ssh.ServerConfig{}
 
-	h.config.PasswordCallback = defaultSSHPasswordCallback(h.options.Users...)
-	if len(h.options.Users) == 0 {
+	if h.options.Authenticator != nil {
+		h.config.PasswordCallback = defaultSSHPasswordCallback(h.options.Authenticator, h.options.AuthGuard)
+	}
+	if len(h.options.AuthorizedKeys) > 0 {
+		h.config.PublicKeyCallback = defaultSSHPublicKeyCallback(h.options.AuthorizedKeys)
+	}
+	if h.config.PasswordCallback == nil && h.config.PublicKeyCallback == nil {
 		h.config.NoClientAuth = true
 	}
 	tlsConfig := h.options.TLSConfig
@@ -492,7 +479,7 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 				}
 
 				go ssh.DiscardRequests(requests)
-				go h.directPortForwardChannel(channel, fmt.Sprintf("%s:%d", p.Host1, p.Port1))
+				go h.directPortForwardChannel(conn, channel, fmt.Sprintf("%s:%d", p.Host1, p.Port1))
 			default:
 				log.Log("[ssh] Unknown channel type:", t)
 				newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
@@ -503,17 +490,17 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 	conn.Wait()
 }
 
-func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr string) {
+func (h *sshForwardHandler) directPortForwardChannel(sshConn ssh.Conn, channel ssh.Channel, raddr string) {
 	defer channel.Close()
 
 	log.Logf("[ssh-tcp] %s - %s", h.options.Addr, raddr)
 
-	if !Can("tcp", raddr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", raddr, sshConn.RemoteAddr(), sshConnUser(sshConn)) {
 		log.Logf("[ssh-tcp] Unauthorized to tcp connect to %s", raddr)
 		return
 	}
 
-	if h.options.Bypass.Contains(raddr) {
+	if h.options.bypass(raddr) {
 		log.Logf("[ssh-tcp] [bypass] %s", raddr)
 		return
 	}
@@ -547,7 +534,7 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 
 	addr := fmt.Sprintf("%s:%d", t.Host, t.Port)
 
-	if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("rtcp", addr, sshConn.RemoteAddr(), sshConnUser(sshConn)) {
 		log.Logf("[ssh-rtcp] Unauthorized to tcp bind to %s", addr)
 		req.Reply(false, nil)
 		return
@@ -620,10 +607,17 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 	<-quit
 }
 
-// SSHConfig holds the SSH tunnel server config
+// SSHConfig holds the SSH tunnel config.
+// The Users, Authenticator, AuthorizedKeys, AuthGuard and TLSConfig are used by the server,
+// the Key and HostKeyCallback are used by the client.
 type SSHConfig struct {
-	Users     []*url.Userinfo
-	TLSConfig *tls.Config
+	Users           []*url.Userinfo // Deprecated: use Authenticator instead.
+	Authenticator   Authenticator
+	AuthorizedKeys  map[string]string // the authorized public keys indexed by the marshaled key, the value is the user of the key.
+	AuthGuard       *AuthGuard
+	TLSConfig       *tls.Config
+	Key             ssh.Signer          // the private key for public key authentication.
+	HostKeyCallback ssh.HostKeyCallback // all host keys are accepted if it is nil.
 }
 
 type sshTunnelListener struct {
@@ -644,9 +638,19 @@ func SSHTunnelListener(addr string, config *SSHConfig) (Listener, error) {
 		config = &SSHConfig{}
 	}
 
+	au := config.Authenticator
+	if au == nil && len(config.Users) > 0 {
+		au = UsersAuthenticator(config.Users...)
+	}
+
 	sshConfig := &ssh.ServerConfig{}
-	sshConfig.PasswordCallback = defaultSSHPasswordCallback(config.Users...)
-	if len(config.Users) == 0 {
+	if au != nil {
+		sshConfig.PasswordCallback = defaultSSHPasswordCallback(au, config.AuthGuard)
+	}
+	if len(config.AuthorizedKeys) > 0 {
+		sshConfig.PublicKeyCallback = defaultSSHPublicKeyCallback(config.AuthorizedKeys)
+	}
+	if sshConfig.PasswordCallback == nil && sshConfig.PublicKeyCallback == nil {
 		sshConfig.NoClientAuth = true
 	}
 	tlsConfig := config.TLSConfig
@@ -762,23 +766,148 @@ func getHostPortFromAddr(addr net.Addr) (host string, port int, err error) {
 	return
 }
 
+// sshUserExtension is the extension of the ssh.Permissions for the identity of the authenticated user.
+const sshUserExtension = "gost-user"
+
+// sshConnUser returns the identity of the user authenticated by the server,
+// it is used to look up the permissions instead of the user name sent by the client.
+func sshConnUser(conn ssh.Conn) string {
+	if sc, ok := conn.(*ssh.ServerConn); ok && sc.Permissions != nil {
+		return sc.Permissions.Extensions[sshUserExtension]
+	}
+	return ""
+}
+
 // PasswordCallbackFunc is a callback function used by SSH server.
 type PasswordCallbackFunc func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)
 
-func defaultSSHPasswordCallback(users ...*url.Userinfo) PasswordCallbackFunc {
+func defaultSSHPasswordCallback(au Authenticator, guard *AuthGuard) PasswordCallbackFunc {
 	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-		for _, user := range users {
-			u := user.Username()
-			p, _ := user.Password()
-			if u == conn.User() && p == string(password) {
-				return nil, nil
-			}
+		ip := addrIP(conn.RemoteAddr())
+		if guard.Banned(ip) {
+			log.Logf("[ssh] %s -> %s : banned", conn.RemoteAddr(), conn.LocalAddr())
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
 		}
+		// the password must be matched exactly, the users without password,
+		// which are authenticated by the name only, are not allowed to log in by password.
+		if id, ok := authenticate(au, conn.User(), string(password)); ok && len(password) > 0 && !sshPasswordless(au, conn.User()) {
+			guard.Succeed(ip)
+			return &ssh.Permissions{
+				Extensions: map[string]string{sshUserExtension: id},
+			}, nil
+		}
+		guard.Fail(ip, conn.User())
 		log.Logf("[ssh] %s -> %s : password rejected for %s", conn.RemoteAddr(), conn.LocalAddr(), conn.User())
 		return nil, fmt.Errorf("password rejected for %s", conn.User())
 	}
 }
 
+// sshPasswordless reports whether the user is authenticated without password.
+func sshPasswordless(au Authenticator, user string) bool {
+	_, ok := authenticate(au, user, "")
+	return ok
+}
+
+// PublicKeyCallbackFunc is a callback function used by SSH server.
+type PublicKeyCallbackFunc func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+
+// defaultSSHPublicKeyCallback accepts the authorized key of the user,
+// the key without a user is accepted for any user name, and its identity is empty.
+func defaultSSHPublicKeyCallback(keys map[string]string) PublicKeyCallbackFunc {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if user, ok := keys[string(key.Marshal())]; ok && (user == "" || user == conn.User()) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"pubkey-fp":      ssh.FingerprintSHA256(key),
+					sshUserExtension: user,
+				},
+			}, nil
+		}
+		log.Logf("[ssh] %s -> %s : unknown public key for %s", conn.RemoteAddr(), conn.LocalAddr(), conn.User())
+		return nil, fmt.Errorf("unknown public key for %s", conn.User())
+	}
+}
+
+// ParseSSHAuthorizedKeys parses the public keys in the OpenSSH authorized_keys format.
+// The user="name" option of the key is the user of the key, the client must log in as the user with the key,
+// the key without the option can be used by any user name, and no per-user permissions are applied.
+// The comment of the key is ignored. The invalid lines are skipped,
+// an error is returned only if there is no valid key.
+func ParseSSHAuthorizedKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	var lastErr error
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			log.Logf("[ssh] authorized keys: %s: %s", line, err)
+			lastErr = err
+			continue
+		}
+		keys[string(key.Marshal())] = sshKeyUser(options)
+	}
+	if len(keys) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("ssh: no authorized key")
+		}
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// sshKeyUser returns the value of the user="name" option of the authorized key.
+func sshKeyUser(options []string) string {
+	for _, opt := range options {
+		n := strings.IndexByte(opt, '=')
+		if n < 0 || strings.ToLower(opt[:n]) != "user" {
+			continue
+		}
+		if user, err := strconv.Unquote(opt[n+1:]); err == nil {
+			return user
+		}
+		return opt[n+1:]
+	}
+	return ""
+}
+
+// SSHFingerprintHostKeyCallback creates a HostKeyCallback that accepts the host key matches the fingerprint,
+// the fingerprint can be in SHA256 (SHA256:xxx) or legacy MD5 (xx:xx:...) format.
+func SSHFingerprintHostKeyCallback(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ssh.FingerprintSHA256(key) == fingerprint ||
+			ssh.FingerprintLegacyMD5(key) == strings.TrimPrefix(fingerprint, "MD5:") {
+			return nil
+		}
+		return fmt.Errorf("ssh: host key fingerprint mismatch for %s: %s", hostname, ssh.FingerprintSHA256(key))
+	}
+}
+
+func sshClientConfig(opts *HandshakeOptions) *ssh.ClientConfig {
+	config := &ssh.ClientConfig{
+		Timeout:         opts.Timeout,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if c := opts.SSHConfig; c != nil {
+		if c.Key != nil {
+			config.Auth = append(config.Auth, ssh.PublicKeys(c.Key))
+		}
+		if c.HostKeyCallback != nil {
+			config.HostKeyCallback = c.HostKeyCallback
+		}
+	}
+	if opts.User != nil {
+		config.User = opts.User.Username()
+		// the password is also tried if it is set, as the server may not accept the key.
+		if password, ok := opts.User.Password(); ok || len(config.Auth) == 0 {
+			config.Auth = append(config.Auth, ssh.Password(password))
+		}
+	}
+	return config
+}
+
 type sshNopConn struct {
 	session *sshSession
 }
@@ -0,0 +1,180 @@
+package gost
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func sshTestSigner(t *testing.T) ssh.Signer {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestParseSSHAuthorizedKeys(t *testing.T) {
+	k1, k2, k3 := sshTestSigner(t).PublicKey(), sshTestSigner(t).PublicKey(), sshTestSigner(t).PublicKey()
+	data := "# comment\n\n" +
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k1))) + " alice@laptop\n" +
+		"no-pty,user=\"alice\" " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k2))) + " bob@desktop\n" +
+		"ssh-ed25519 invalid\n" + // skipped
+		string(ssh.MarshalAuthorizedKey(k3)) +
+		"# trailing comment\n"
+
+	keys, err := ParseSSHAuthorizedKeys([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, ok1 := keys[string(k1.Marshal())]
+	u2, ok2 := keys[string(k2.Marshal())]
+	u3, ok3 := keys[string(k3.Marshal())]
+	if len(keys) != 3 || !ok1 || !ok2 || !ok3 || u1 != "" || u2 != "alice" || u3 != "" {
+		t.Errorf("wrong keys: %v", keys)
+	}
+
+	if _, err := ParseSSHAuthorizedKeys([]byte("# no keys\n")); err == nil {
+		t.Error("should return error for no keys")
+	}
+}
+
+func sshPublicKeyAuthRoundtrip(config *SSHConfig, user *url.Userinfo, clientConfig *SSHConfig) error {
+	ln, err := SSHTunnelListener("127.0.0.1:0", config)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().String()
+	tr := SSHTunnelTransporter()
+	conn, err := tr.Dial(addr)
+	if err != nil {
+		return err
+	}
+	cc, err := tr.Handshake(conn,
+		AddrHandshakeOption(addr),
+		UserHandshakeOption(user),
+		SSHConfigHandshakeOption(clientConfig),
+	)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	if _, err := cc.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	_, err = io.ReadFull(cc, b)
+	return err
+}
+
+type sshTestConnMetadata struct {
+	user string
+}
+
+func (c *sshTestConnMetadata) User() string          { return c.user }
+func (c *sshTestConnMetadata) SessionID() []byte     { return nil }
+func (c *sshTestConnMetadata) ClientVersion() []byte { return nil }
+func (c *sshTestConnMetadata) ServerVersion() []byte { return nil }
+func (c *sshTestConnMetadata) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *sshTestConnMetadata) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestSSHPasswordCallback(t *testing.T) {
+	callback := defaultSSHPasswordCallback(UsersAuthenticator(
+		url.UserPassword("admin", "123456"),
+		url.User("guest"),
+	), nil)
+
+	var tests = []struct {
+		user, password string
+		ok             bool
+	}{
+		{"admin", "123456", true},
+		{"admin", "654321", false},
+		{"admin", "", false},
+		{"guest", "", false}, // the users without password can not log in by password
+		{"guest", "any", false},
+		{"nobody", "123456", false},
+	}
+	for _, test := range tests {
+		_, err := callback(&sshTestConnMetadata{user: test.user}, []byte(test.password))
+		if (err == nil) != test.ok {
+			t.Errorf("%s:%s: got %v, want ok %v", test.user, test.password, err, test.ok)
+		}
+	}
+}
+
+func TestSSHPublicKeyAuth(t *testing.T) {
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, otherKey, anyKey := sshTestSigner(t), sshTestSigner(t), sshTestSigner(t)
+
+	config := &SSHConfig{
+		AuthorizedKeys: map[string]string{
+			string(clientKey.PublicKey().Marshal()): "gost",
+			string(anyKey.PublicKey().Marshal()):    "",
+		},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	fingerprint := ssh.FingerprintSHA256(hostKey.PublicKey())
+
+	var tests = []struct {
+		user        string
+		key         ssh.Signer
+		fingerprint string
+		ok          bool
+	}{
+		{"gost", clientKey, fingerprint, true},
+		{"gost", clientKey, ssh.FingerprintLegacyMD5(hostKey.PublicKey()), true},
+		{"admin", clientKey, fingerprint, false}, // the key belongs to the user gost
+		{"admin", anyKey, fingerprint, true},
+		{"gost", otherKey, fingerprint, false},
+		{"gost", clientKey, ssh.FingerprintSHA256(otherKey.PublicKey()), false},
+	}
+
+	for i, test := range tests {
+		err := sshPublicKeyAuthRoundtrip(config, url.User(test.user), &SSHConfig{
+			Key:             test.key,
+			HostKeyCallback: SSHFingerprintHostKeyCallback(test.fingerprint),
+		})
+		if test.ok && err != nil {
+			t.Errorf("#%d: %v", i, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("#%d: should fail", i)
+		}
+	}
+}
@@ -304,3 +304,50 @@ func wrapTLSClient(conn net.Conn, tlsConfig *tls.Config, timeout time.Duration)
 
 	return tlsConn, err
 }
+
+// tlsConnectionState returns the state of the TLS connection underlying conn,
+// it unwraps the connections of the multiplex, websocket and HTTP2 transports.
+func tlsConnectionState(conn net.Conn) *tls.ConnectionState {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.Handshake(); err != nil {
+			return nil
+		}
+		state := c.ConnectionState()
+		return &state
+	case *bufferdConn:
+		return tlsConnectionState(c.Conn)
+	case *muxStreamConn:
+		return tlsConnectionState(c.Conn)
+	case *websocketConn:
+		return tlsConnectionState(c.conn.UnderlyingConn())
+	case *http2ServerConn:
+		return c.r.TLS
+	case *http2Conn:
+		return c.tlsState
+	}
+	return nil
+}
+
+// tlsClientUser returns the user name of the verified client certificate of conn.
+// The user name is the common name of the certificate,
+// or the first DNS name or email address in the subject alternative names if the common name is empty.
+func tlsClientUser(conn net.Conn) string {
+	return tlsStateUser(tlsConnectionState(conn))
+}
+
+func tlsStateUser(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
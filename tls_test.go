@@ -0,0 +1,127 @@
+package gost
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func genTestCert(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: cert}, cert, nil
+}
+
+func TestTLSClientUser(t *testing.T) {
+	now := time.Now()
+	ca, caCert, err := genTestCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gost test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey := ca.PrivateKey.(*ecdsa.PrivateKey)
+
+	serverCert, _, err := genTestCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	var tests = []struct {
+		subject pkix.Name
+		dns     []string
+		email   []string
+		user    string
+	}{
+		{pkix.Name{CommonName: "alice"}, []string{"bob.example.com"}, nil, "alice"},
+		{pkix.Name{}, []string{"bob.example.com"}, []string{"carol@example.com"}, "bob.example.com"},
+		{pkix.Name{}, nil, []string{"carol@example.com"}, "carol@example.com"},
+	}
+
+	for i, test := range tests {
+		clientCert, _, err := genTestCert(&x509.Certificate{
+			SerialNumber:   big.NewInt(int64(10 + i)),
+			Subject:        test.subject,
+			DNSNames:       test.dns,
+			EmailAddresses: test.email,
+			NotBefore:      now.Add(-time.Hour),
+			NotAfter:       now.Add(time.Hour),
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, caCert, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c1, c2 := net.Pipe()
+		server := tls.Server(c1, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		client := tls.Client(c2, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		})
+		errc := make(chan error, 1)
+		go func() {
+			errc <- client.Handshake()
+		}()
+
+		conn := &muxStreamConn{Conn: server}
+		if user := tlsClientUser(conn); user != test.user {
+			t.Errorf("#%d: user should be %s, got %s", i, test.user, user)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("#%d: %v", i, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestTLSClientUserNoCert(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if user := tlsClientUser(c1); user != "" {
+		t.Errorf("user should be empty, got %s", user)
+	}
+	if user := tlsStateUser(&tls.ConnectionState{}); user != "" {
+		t.Errorf("user should be empty, got %s", user)
+	}
+}